@@ -0,0 +1,58 @@
+// Command toys runs any of the Machine Box toys.
+//
+//	toys imgclass -src ./teaching-images
+//	toys anonproxy -addr :8000
+package main
+
+import (
+	"os"
+
+	"github.com/machinebox/toys/internal/anonproxy"
+	"github.com/machinebox/toys/internal/anonsign"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/machinebox/toys/internal/demo"
+	"github.com/machinebox/toys/internal/imdbteach"
+	"github.com/machinebox/toys/internal/imgclass"
+	"github.com/machinebox/toys/internal/nevernude"
+	"github.com/machinebox/toys/internal/textclass"
+)
+
+var commands = []cli.Command{
+	imgclass.Command,
+	textclass.Command,
+	anonproxy.Command,
+	anonproxy.BatchCommand,
+	anonproxy.VideoCommand,
+	anonproxy.DeanonymiseCommand,
+	anonsign.Command,
+	nevernude.Command,
+	imdbteach.Command,
+	demo.Command,
+}
+
+func main() {
+	cli.Program = "toys"
+	args := os.Args[1:]
+	if len(args) == 0 {
+		cli.PrintCommands("toys", commands)
+		os.Exit(2)
+	}
+	name := args[0]
+	args = args[1:]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) == 0 {
+			cli.PrintCommands("toys", commands)
+			return
+		}
+		// ask the command for its own help
+		name, args = args[0], []string{"-h"}
+	}
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			cli.Exec(cmd, args)
+			return
+		}
+	}
+	cli.PrintCommands("toys", commands)
+	os.Exit(2)
+}
@@ -0,0 +1,273 @@
+// Package config loads settings for the toys from a config file,
+// MB_* environment variables and command line flags.
+//
+// Every setting is a flag. Values are taken from (highest priority
+// first):
+//
+//  1. flags on the command line
+//  2. MB_<TOOL>_<FLAG> environment variables, e.g. MB_ANONPROXY_ADDR
+//  3. MB_<FLAG> environment variables, e.g. MB_FACEBOX (except the ones
+//     the boxes use for themselves, like MB_KEY and MB_WORKERS)
+//  4. the tool's section of the config file
+//  5. top level keys in the config file
+//  6. the flag default
+//
+// The config file is YAML or TOML (by extension), and may be shared
+// by all tools:
+//
+//	facebox: http://localhost:8080
+//	cb: http://localhost:8081
+//	anonproxy:
+//	  addr: :8000
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultFiles are the config files looked for in the working directory
+// when none is specified.
+var DefaultFiles = []string{"toys.yaml", "toys.yml", "toys.toml"}
+
+// Secrets are the names of flags that hold secrets, like keys. Print
+// doesn't show their values.
+var Secrets = map[string]bool{
+	"secret":     true,
+	"restorekey": true,
+	"key":        true,
+	"password":   true,
+	"token":      true,
+}
+
+// Config describes the effective settings for a tool.
+type Config struct {
+	// Tool is the name of the tool.
+	Tool string
+	// File is the config file that was used, if any.
+	File string
+	// Settings are the effective values of each flag.
+	Settings []Setting
+}
+
+// Setting is the effective value of a flag and where it came from.
+type Setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// Load parses args into fs, filling in any flags not set on the command
+// line from the environment and config file.
+// Load adds a -config flag to fs to specify the config file, which
+// can also be set with the MB_CONFIG environment variable.
+func Load(tool string, fs *flag.FlagSet, args []string) (*Config, error) {
+	configFile := fs.String("config", "", "config file (YAML or TOML, default is $MB_CONFIG or "+strings.Join(DefaultFiles, ", ")+")")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg := &Config{
+		Tool: tool,
+		File: *configFile,
+	}
+	if cfg.File == "" {
+		cfg.File = os.Getenv("MB_CONFIG")
+	}
+	if cfg.File == "" {
+		for _, name := range DefaultFiles {
+			if _, err := os.Stat(name); err == nil {
+				cfg.File = name
+				break
+			}
+		}
+	}
+	fileValues := make(map[string]string)
+	if cfg.File != "" {
+		var err error
+		fileValues, err = readFile(cfg.File, tool)
+		if err != nil {
+			return nil, errors.Wrap(err, "config")
+		}
+	}
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		setting := Setting{
+			Name:   f.Name,
+			Source: "default",
+		}
+		if onCommandLine[f.Name] {
+			setting.Source = "flag"
+		} else if name, value, ok := lookupEnv(tool, f.Name); ok {
+			if err = fs.Set(f.Name, value); err != nil {
+				err = errors.Wrap(err, name)
+				return
+			}
+			setting.Source = name
+		} else if value, ok := fileValues[f.Name]; ok {
+			if err = fs.Set(f.Name, value); err != nil {
+				err = errors.Wrap(err, cfg.File+": "+f.Name)
+				return
+			}
+			setting.Source = cfg.File
+		}
+		setting.Value = f.Value.String()
+		cfg.Settings = append(cfg.Settings, setting)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Print writes the effective settings to w, leaving out the values of
+// Secrets.
+func (c *Config) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "# %s\n", c.Tool)
+	if c.File != "" {
+		fmt.Fprintf(tw, "# config file: %s\n", c.File)
+	}
+	for _, setting := range c.Settings {
+		value := strconv.Quote(setting.Value)
+		if Secrets[setting.Name] && setting.Value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t# %s\n", setting.Name, value, setting.Source)
+	}
+	tw.Flush()
+}
+
+// Parse is like Load, but also handles the "config print" command by
+// printing the effective settings to stdout.
+// It returns false if the tool should not carry on, either because of an
+// error or because the settings were printed.
+func Parse(tool string, fs *flag.FlagSet, args []string) (bool, error) {
+	args, printConfig := PrintCommand(args)
+	cfg, err := Load(tool, fs, args)
+	if err != nil {
+		return false, err
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return false, nil
+	}
+	return true, nil
+}
+
+// PrintCommand reports whether args is the "config print" command,
+// and returns the arguments that follow it.
+func PrintCommand(args []string) ([]string, bool) {
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		return args[2:], true
+	}
+	return args, false
+}
+
+// reserved are environment variables that the Machine Box boxes use
+// for themselves, so they aren't used for flags.
+var reserved = map[string]bool{
+	"MB_KEY":            true,
+	"MB_PORT":           true,
+	"MB_WORKERS":        true,
+	"MB_DEBUG":          true,
+	"MB_BASICAUTH_USER": true,
+	"MB_BASICAUTH_PASS": true,
+}
+
+// EnvNames gets the environment variables that may hold the value for
+// the flag, in priority order.
+func EnvNames(tool, flagName string) []string {
+	name := envSafe(flagName)
+	names := []string{"MB_" + envSafe(tool) + "_" + name}
+	if !reserved["MB_"+name] {
+		names = append(names, "MB_"+name)
+	}
+	return names
+}
+
+func envSafe(s string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(s))
+}
+
+func lookupEnv(tool, flagName string) (string, string, bool) {
+	for _, name := range EnvNames(tool, flagName) {
+		if value, ok := os.LookupEnv(name); ok {
+			return name, value, true
+		}
+	}
+	return "", "", false
+}
+
+// readFile reads the values from the config file, with values in the
+// tool's section taking priority over top level ones.
+func readFile(path, tool string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if _, err := toml.Decode(string(b), &doc); err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+	default:
+		return nil, errors.New(path + ": unknown config file format (use .yaml or .toml)")
+	}
+	values := make(map[string]string)
+	var section map[string]interface{}
+	for key, value := range doc {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if key == tool {
+				section = v
+			}
+		case map[interface{}]interface{}:
+			if key == tool {
+				section = make(map[string]interface{})
+				for k, vv := range v {
+					section[fmt.Sprint(k)] = vv
+				}
+			}
+		default:
+			values[key] = formatValue(value)
+		}
+	}
+	for key, value := range section {
+		values[key] = formatValue(value)
+	}
+	return values, nil
+}
+
+func formatValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i := range list {
+			items[i] = fmt.Sprint(list[i])
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestLoad(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "config")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "toys.yaml")
+	err = ioutil.WriteFile(file, []byte(`
+facebox: http://file:8080
+addr: ":1"
+threshold: 0.5
+sometool:
+  addr: ":2"
+`), 0666)
+	is.NoErr(err)
+	os.Setenv("MB_SOMETOOL_VERBOSE", "true")
+	defer os.Unsetenv("MB_SOMETOOL_VERBOSE")
+
+	fs := flag.NewFlagSet("sometool", flag.ContinueOnError)
+	var (
+		addr      = fs.String("addr", ":8000", "")
+		facebox   = fs.String("facebox", "http://localhost:8080", "")
+		threshold = fs.Float64("threshold", 0.4, "")
+		verbose   = fs.Bool("verbose", false, "")
+		out       = fs.String("out", "", "")
+	)
+	cfg, err := Load("sometool", fs, []string{"-config", file, "-out", "video.mp4", "in.mp4"})
+	is.NoErr(err)
+	is.Equal(*addr, ":2")                  // tool section beats top level
+	is.Equal(*facebox, "http://file:8080") // top level
+	is.Equal(*threshold, 0.5)
+	is.Equal(*verbose, true) // environment
+	is.Equal(*out, "video.mp4")
+	is.Equal(fs.Args(), []string{"in.mp4"})
+	is.Equal(cfg.File, file)
+	sources := make(map[string]string)
+	for _, setting := range cfg.Settings {
+		sources[setting.Name] = setting.Source
+	}
+	is.Equal(sources["addr"], file)
+	is.Equal(sources["verbose"], "MB_SOMETOOL_VERBOSE")
+	is.Equal(sources["out"], "flag")
+}
+
+func TestPrintCommand(t *testing.T) {
+	is := is.New(t)
+
+	args, ok := PrintCommand([]string{"config", "print", "-cb", "http://cb"})
+	is.True(ok)
+	is.Equal(args, []string{"-cb", "http://cb"})
+	args, ok = PrintCommand([]string{"-cb", "http://cb"})
+	is.True(!ok)
+	is.Equal(args, []string{"-cb", "http://cb"})
+}
+
+func TestPrint(t *testing.T) {
+	is := is.New(t)
+
+	cfg := &Config{
+		Tool: "sometool",
+		Settings: []Setting{
+			{Name: "addr", Value: ":8000", Source: "default"},
+			{Name: "secret", Value: "hunter2", Source: "MB_SECRET"},
+			{Name: "restorekey", Value: "00112233445566778899aabbccddeeff", Source: "flag"},
+			{Name: "key", Value: "", Source: "default"},
+		},
+	}
+	var buf bytes.Buffer
+	cfg.Print(&buf)
+	out := buf.String()
+	is.True(strings.Contains(out, `":8000"`))
+	is.True(strings.Contains(out, "<redacted>"))
+	is.True(!strings.Contains(out, "hunter2"))
+	is.True(!strings.Contains(out, "00112233"))
+	is.True(strings.Contains(out, `""`)) // empty secrets are shown as empty
+}
+
+func TestEnvNames(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(EnvNames("anonproxy", "cache-dir"), []string{"MB_ANONPROXY_CACHE_DIR", "MB_CACHE_DIR"})
+	is.Equal(EnvNames("deanonymise", "key"), []string{"MB_DEANONYMISE_KEY"})     // MB_KEY is the Machine Box key
+	is.Equal(EnvNames("anonbatch", "workers"), []string{"MB_ANONBATCH_WORKERS"}) // MB_WORKERS is for the boxes
+}
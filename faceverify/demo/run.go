@@ -1,19 +1,10 @@
 package main
 
 import (
-	"flag"
-	"log"
-	"net/http"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/machinebox/toys/internal/demo"
 )
 
 func main() {
-	var (
-		addr = flag.String("addr", ":9000", "listen address")
-	)
-	flag.Parse()
-	http.Handle("/", http.FileServer(http.Dir("public")))
-	log.Println("listening on", *addr)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		log.Fatalln(err)
-	}
+	cli.Main(demo.Command)
 }
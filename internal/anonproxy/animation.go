@@ -0,0 +1,345 @@
+package anonproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"math"
+	"sort"
+
+	"github.com/machinebox/sdk-go/facebox"
+)
+
+// animation is a redacted animated GIF.
+// As an image.Image it is the first frame, so it can still be encoded
+// in other formats.
+type animation struct {
+	image.Image
+	gif *gif.GIF
+}
+
+// maxFrames is the most frames an animated GIF may have, since each
+// keyframe is a check with Facebox.
+const maxFrames = 500
+
+// anonymiseGIF redacts the faces in every frame of an animated GIF.
+// Faces are found in every opts.keyframes frames, and tracked in between
+// (or found in the frames in between too, if they can't be tracked).
+// The frames keep their delays and disposal, and the loop count is kept.
+func (s *server) anonymiseGIF(g *gif.GIF, opts options) (*animation, report, error) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	every := opts.keyframes
+	if every < 1 {
+		every = 1
+	}
+	last := len(g.Image) - 1
+	// find the faces in the keyframes
+	keyFound := make(map[int]detections)
+	err := composite(g, bounds, func(i int, frame *image.RGBA) error {
+		if i%every != 0 && i != last {
+			return nil
+		}
+		found, err := s.checkFrame(frame)
+		if err != nil {
+			return err
+		}
+		keyFound[i] = found
+		return nil
+	})
+	if err != nil {
+		return nil, report{}, err
+	}
+	// check the frames between keyframes whose faces can't all be
+	// paired up, rather than leave them unredacted
+	between := make(map[int]bool)
+	for prev := 0; prev < last; prev += every {
+		next := prev + every
+		if next > last {
+			next = last
+		}
+		if paired(keyFound[prev], keyFound[next]) {
+			continue
+		}
+		for i := prev + 1; i < next; i++ {
+			between[i] = true
+		}
+	}
+	if len(between) > 0 {
+		err := composite(g, bounds, func(i int, frame *image.RGBA) error {
+			if !between[i] {
+				return nil
+			}
+			found, err := s.checkFrame(frame)
+			if err != nil {
+				return err
+			}
+			keyFound[i] = found
+			return nil
+		})
+		if err != nil {
+			return nil, report{}, err
+		}
+	}
+	out := &gif.GIF{
+		Image:           make([]*image.Paletted, len(g.Image)),
+		Delay:           g.Delay,
+		Disposal:        g.Disposal,
+		LoopCount:       g.LoopCount,
+		Config:          g.Config,
+		BackgroundIndex: g.BackgroundIndex,
+	}
+	rep := opts.report(detections{}, bounds)
+	rep.Frames = len(g.Image)
+	var first image.Image
+	// redact each frame
+	err = composite(g, bounds, func(i int, frame *image.RGBA) error {
+		found, ok := keyFound[i]
+		if !ok {
+			prev := i - i%every
+			next := prev + every
+			if next > last {
+				next = last
+			}
+			t := float64(i-prev) / float64(next-prev)
+			found = interpolate(keyFound[prev], keyFound[next], t)
+		}
+		redacted := image.NewRGBA(frame.Bounds())
+		draw.Draw(redacted, redacted.Bounds(), frame, frame.Bounds().Min, draw.Src)
+		frameRep := opts.report(found, bounds)
+		for _, face := range frameRep.Faces {
+			face.Frame = i
+			rep.Faces = append(rep.Faces, face)
+		}
+		for _, object := range frameRep.Objects {
+			object.Frame = i
+			rep.Objects = append(rep.Objects, object)
+		}
+		var changed []image.Rectangle
+		for _, area := range frameRep.areas() {
+			opts.redact(redacted, area)
+			changed = append(changed, area.Inset(-opts.feather).Intersect(bounds))
+		}
+		rep.Redacted += frameRep.Redacted
+		out.Image[i] = redactFrame(g.Image[i], redacted, changed)
+		if i == 0 {
+			first = redacted
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, report{}, err
+	}
+	return &animation{Image: first, gif: out}, rep, nil
+}
+
+// checkFrame finds the faces and objects in a frame of an animation or
+// video.
+func (s *server) checkFrame(frame image.Image) (detections, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, frame, &jpeg.Options{Quality: 90}); err != nil {
+		return detections{}, err
+	}
+	return s.detectAll(buf.Bytes())
+}
+
+// composite calls fn with each frame of the GIF as it is shown, drawn
+// over the frames before it. The frame is only valid during the call.
+func composite(g *gif.GIF, bounds image.Rectangle, fn func(i int, frame *image.RGBA) error) error {
+	canvas := image.NewRGBA(bounds)
+	var previous *image.RGBA
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if err := fn(i, canvas); err != nil {
+			return err
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+	return nil
+}
+
+// redactFrame makes a new GIF frame from the original, with the changed
+// areas taken from the redacted image. The frame grows to cover the
+// changed areas, so the redaction covers whatever is left from earlier
+// frames.
+func redactFrame(frame *image.Paletted, redacted *image.RGBA, changed []image.Rectangle) *image.Paletted {
+	if len(changed) == 0 {
+		return frame
+	}
+	r := frame.Bounds()
+	for _, c := range changed {
+		r = r.Union(c)
+	}
+	palette := make(color.Palette, len(frame.Palette))
+	copy(palette, frame.Palette)
+	transparent := transparentIndex(palette)
+	if transparent == -1 && len(palette) < 256 && r != frame.Bounds() {
+		palette = append(palette, color.Transparent)
+		transparent = len(palette) - 1
+	}
+	out := image.NewPaletted(r, palette)
+	if transparent != -1 {
+		// the new parts of the frame leave earlier frames showing
+		for i := range out.Pix {
+			out.Pix[i] = uint8(transparent)
+		}
+	} else {
+		// no way to leave earlier frames showing, so draw them in
+		draw.Draw(out, r, redacted, r.Min, draw.Src)
+	}
+	for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+		copy(out.Pix[out.PixOffset(frame.Rect.Min.X, y):], frame.Pix[frame.PixOffset(frame.Rect.Min.X, y):frame.PixOffset(frame.Rect.Max.X, y)])
+	}
+	// only use opaque colours, so nothing shows through the redaction
+	var opaque color.Palette
+	var indexes []uint8
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0xffff {
+			opaque = append(opaque, c)
+			indexes = append(indexes, uint8(i))
+		}
+	}
+	if len(opaque) == 0 {
+		opaque = palette
+		for i := range palette {
+			indexes = append(indexes, uint8(i))
+		}
+	}
+	for _, c := range changed {
+		for y := c.Min.Y; y < c.Max.Y; y++ {
+			for x := c.Min.X; x < c.Max.X; x++ {
+				out.SetColorIndex(x, y, indexes[opaque.Index(redacted.RGBAAt(x, y))])
+			}
+		}
+	}
+	return out
+}
+
+// transparentIndex gets the index of the first fully transparent colour
+// in the palette, or -1 if there isn't one.
+func transparentIndex(palette color.Palette) int {
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// interpolateFaces estimates where the faces are t (0 to 1) of the way
+// from a frame with faces a to a later frame with faces b.
+// Faces are paired with the nearest face that is up to a face width
+// away, and faces without a pair are kept where they are, so nothing is
+// missed in between.
+func interpolateFaces(a, b []facebox.Face, t float64) []facebox.Face {
+	rectsA := make([]image.Rectangle, len(a))
+	for i := range a {
+		rectsA[i] = faceRect(a[i])
+	}
+	rectsB := make([]image.Rectangle, len(b))
+	for j := range b {
+		rectsB[j] = faceRect(b[j])
+	}
+	var faces []facebox.Face
+	for _, p := range pairRects(rectsA, rectsB, nil) {
+		switch {
+		case p.j == -1:
+			faces = append(faces, a[p.i])
+		case p.i == -1:
+			faces = append(faces, b[p.j])
+		default:
+			face := a[p.i]
+			r := lerpRect(rectsA[p.i], rectsB[p.j], t)
+			face.Rect = facebox.Rect{Top: r.Min.Y, Left: r.Min.X, Width: r.Dx(), Height: r.Dy()}
+			faces = append(faces, face)
+		}
+	}
+	return faces
+}
+
+// rectPair is a pair of indexes of rectangles in two frames that are
+// probably the same thing. An index is -1 if there is no pair.
+type rectPair struct {
+	i, j int
+}
+
+// pairRects pairs each rectangle in a with the nearest one in b that is
+// up to a width away (and for which same, if not nil, is true), nearest
+// first. Rectangles without a pair come after the pairs.
+func pairRects(a, b []image.Rectangle, same func(i, j int) bool) []rectPair {
+	type candidate struct {
+		rectPair
+		distance float64
+	}
+	var candidates []candidate
+	for i := range a {
+		for j := range b {
+			if same != nil && !same(i, j) {
+				continue
+			}
+			d := distance(a[i], b[j])
+			if d <= float64(max(a[i].Dx(), b[j].Dx())) {
+				candidates = append(candidates, candidate{rectPair{i, j}, d})
+			}
+		}
+	}
+	sort.Slice(candidates, func(x, y int) bool {
+		return candidates[x].distance < candidates[y].distance
+	})
+	pairedA := make(map[int]bool)
+	pairedB := make(map[int]bool)
+	var pairs []rectPair
+	for _, c := range candidates {
+		if pairedA[c.i] || pairedB[c.j] {
+			continue
+		}
+		pairedA[c.i], pairedB[c.j] = true, true
+		pairs = append(pairs, c.rectPair)
+	}
+	for i := range a {
+		if !pairedA[i] {
+			pairs = append(pairs, rectPair{i, -1})
+		}
+	}
+	for j := range b {
+		if !pairedB[j] {
+			pairs = append(pairs, rectPair{-1, j})
+		}
+	}
+	return pairs
+}
+
+// distance is the distance between the centres of two rectangles.
+func distance(a, b image.Rectangle) float64 {
+	dx := float64(a.Min.X+a.Dx()/2) - float64(b.Min.X+b.Dx()/2)
+	dy := float64(a.Min.Y+a.Dy()/2) - float64(b.Min.Y+b.Dy()/2)
+	return math.Hypot(dx, dy)
+}
+
+// lerpRect gets the rectangle t (0 to 1) of the way from a to b.
+func lerpRect(a, b image.Rectangle, t float64) image.Rectangle {
+	x, y := lerp(a.Min.X, b.Min.X, t), lerp(a.Min.Y, b.Min.Y, t)
+	return image.Rect(x, y, x+lerp(a.Dx(), b.Dx(), t), y+lerp(a.Dy(), b.Dy(), t))
+}
+
+func lerp(a, b int, t float64) int {
+	return int(math.Round(float64(a) + float64(b-a)*t))
+}
@@ -0,0 +1,269 @@
+package anonproxy
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+)
+
+// summary describes the command in help output.
+const summary = "Image proxy server to anonymise images"
+
+// Command is the anonproxy command.
+var Command = cli.Command{
+	Name:    "anonproxy",
+	Summary: summary,
+	Run:     Run,
+}
+
+// Run runs the anonproxy server.
+func Run(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("anonproxy", summary+".")
+	var (
+		addr         = flags.String("addr", "localhost:8000", "Listen address")
+		faceboxAddr  = flags.String("facebox", "http://localhost:8080", "Facebox address")
+		settings     = redactionFlags(flags)
+		outSettings  = outputFlags(flags)
+		restore      = restoreFlags(flags)
+		detectors    = detectorFlags(flags)
+		schemes      = flags.String("schemes", "http,https", "comma separated URL schemes that src may use")
+		allowHosts   = flags.String("allowhosts", "", "comma separated hosts that src may use (*.example.com matches subdomains; empty allows any)")
+		denyHosts    = flags.String("denyhosts", "", "comma separated hosts that src may not use (*.example.com matches subdomains)")
+		allowPrivate = flags.Bool("allowprivate", false, "allow src to use loopback, private and link-local addresses")
+		maxSize      = flags.Int64("maxsize", 20, "maximum size of source images in MB")
+		reportFaces  = flags.String("report", "", "set to header to describe the faces in an X-Faces-Redacted header by default")
+		cacheSize    = flags.Int64("cachesize", 64, "size of the in-memory cache of redacted images in MB (0 disables it)")
+		cacheDir     = flags.String("cachedir", "", "directory to also cache redacted images on disk")
+		cacheDirSize = flags.Int64("cachedirsize", 1024, "most MB of images to keep in -cachedir; least recently used are removed first (0 for no limit)")
+		cacheDirAge  = flags.Duration("cachedirage", 7*24*time.Hour, "how long to keep images in -cachedir after they were last used (0 for ever)")
+		cacheTTL     = flags.Duration("cachettl", 5*time.Minute, "how long to cache images when the source doesn't say")
+		maxChecks    = flags.Int("maxchecks", 8, "most images to check with Facebox at once; more get 503 Service Unavailable (0 for no limit)")
+		rateLimit    = flags.Float64("ratelimit", 0, "requests a second allowed from each client (0 for no limit)")
+		rateBurst    = flags.Int("rateburst", 10, "requests each client may make at once, on top of -ratelimit")
+		trustFwd     = flags.Bool("trustforwarded", false, "identify clients by X-Forwarded-For, when behind a reverse proxy")
+		readTimeout  = flags.Duration("readtimeout", 30*time.Second, "longest time to read a request, including uploads")
+		writeTimeout = flags.Duration("writetimeout", 60*time.Second, "longest time to respond to a request, from the end of reading it")
+		shutdownTime = flags.Duration("shutdowntimeout", 30*time.Second, "how long to let requests finish when shutting down")
+		accessLog    = flags.Bool("accesslog", true, "write a JSON line to stderr for each request")
+		secret       = flags.String("secret", "", "secret key that request URLs must be signed with (see the anonsign command; empty allows unsigned requests)")
+		consentFile  = flags.String("consent", "", "JSON file of the consent registry; people who have refused consent are always redacted (empty for no registry)")
+		adminAddr    = flags.String("adminaddr", "localhost:8001", "listen address for the Prometheus metrics and the admin API to manage the consent registry (keep it private; empty turns it off)")
+		overrides    = flags.Bool("overrides", false, "let any parameter redact less than the defaults, e.g. a weaker style, fewer faces or less padding (otherwise they can only redact more)")
+	)
+	if ok, err := config.Parse("anonproxy", flags, args); !ok {
+		return err
+	}
+	defaults, mask, err := settings()
+	if err != nil {
+		return err
+	}
+	restoreKey, err := restore(defaults)
+	if err != nil {
+		return err
+	}
+	if err := outSettings(defaults); err != nil {
+		return err
+	}
+	defaults["report"] = *reportFaces
+	fetcher := newFetcher(fetcherOptions{
+		schemes:      *schemes,
+		allowHosts:   *allowHosts,
+		denyHosts:    *denyHosts,
+		allowPrivate: *allowPrivate,
+		maxSize:      *maxSize << 20,
+		timeout:      10 * time.Second,
+	})
+	fb, err := cli.Facebox(ctx, *faceboxAddr)
+	if err != nil {
+		return err
+	}
+	ds, err := detectors(ctx)
+	if err != nil {
+		return err
+	}
+	srv := newServer(fb, fetcher, defaults, mask)
+	srv.detectors = ds
+	srv.cacheTTL = *cacheTTL
+	if *cacheSize > 0 || *cacheDir != "" {
+		srv.cache = newCache(*cacheSize<<20, *cacheDir)
+		srv.cache.dirMaxSize = *cacheDirSize << 20
+		srv.cache.dirMaxAge = *cacheDirAge
+	}
+	if *maxChecks > 0 {
+		srv.checks = make(chan struct{}, *maxChecks)
+	}
+	if *rateLimit > 0 {
+		srv.limiter = newRateLimiter(*rateLimit, *rateBurst)
+	}
+	srv.trustForwarded = *trustFwd
+	srv.accessLog = *accessLog
+	if *secret != "" {
+		srv.secret = []byte(*secret)
+	}
+	srv.restoreKey = restoreKey
+	srv.overrides = *overrides
+	if *consentFile != "" {
+		if srv.consent, err = loadConsent(*consentFile); err != nil {
+			return err
+		}
+	}
+	var adminServer *http.Server
+	if *adminAddr != "" {
+		adminServer = &http.Server{
+			Addr:              *adminAddr,
+			Handler:           srv.admin(),
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *readTimeout + *writeTimeout,
+		}
+		adminListener, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			return errors.Wrap(err, "admin")
+		}
+		go func() {
+			if err := adminServer.Serve(adminListener); err != http.ErrServerClosed {
+				log.Println("admin:", err)
+			}
+		}()
+		fmt.Println("metrics and admin API on", *adminAddr)
+	}
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           srv,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *readTimeout + *writeTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Println("shutting down...")
+		close(srv.stopping)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTime)
+		defer cancel()
+		if adminServer != nil {
+			adminServer.Shutdown(shutdownCtx)
+		}
+		shutdown <- httpServer.Shutdown(shutdownCtx)
+	}()
+	fmt.Println("Facebox at", *faceboxAddr)
+	fmt.Println("listening on", *addr)
+	fmt.Println("usage:", "http://"+*addr+"/?src=http://...")
+	fmt.Println("   or:", "POST images to http://"+*addr+"/anonymise")
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
+
+// redactionFlags adds the flags for the default redaction settings to
+// flags. Once the flags are parsed, call the function it returns to get
+// the defaults, and the mask image if there is one.
+func redactionFlags(flags *flag.FlagSet) func() (map[string]string, image.Image, error) {
+	var (
+		style    = flags.String("style", "solid", "default redaction style (solid, blur, pixelate or mask)")
+		colorHex = flags.String("color", "000000", "default colour for the solid style")
+		block    = flags.Int("block", 0, "default block size in pixels for the pixelate style (0 sizes blocks to the face)")
+		radius   = flags.Int("radius", 0, "default radius in pixels for the blur style (0 sizes the blur to the face)")
+		maskFile = flags.String("mask", "", "PNG image to draw over faces with the mask style")
+		padding  = flags.Float64("padding", 0, "default padding around faces, as a percentage of the face size")
+		shape    = flags.String("shape", "rect", "default redaction shape (rect, ellipse or rounded)")
+		feather  = flags.Int("feather", 0, "default width in pixels of the soft edge of redactions")
+		minSize  = flags.Int("minsize", 0, "default minimum face width and height in pixels to redact")
+		redact   = flags.String("redact", "all", "default faces to redact (all, unmatched, matched, except or consented)")
+		allow    = flags.String("allow", "", "comma separated names or IDs of recognised faces to leave alone with -redact except")
+		labels   = flags.String("labels", "", "default comma separated labels of objects found by -objectbox or -detector to redact, like plate,text (* for all)")
+	)
+	return func() (map[string]string, image.Image, error) {
+		defaults := map[string]string{
+			"style":   *style,
+			"color":   *colorHex,
+			"block":   strconv.Itoa(*block),
+			"radius":  strconv.Itoa(*radius),
+			"padding": strconv.FormatFloat(*padding, 'f', -1, 64),
+			"shape":   *shape,
+			"feather": strconv.Itoa(*feather),
+			"minsize": strconv.Itoa(*minSize),
+			"redact":  *redact,
+			"allow":   *allow,
+			"labels":  *labels,
+		}
+		var mask image.Image
+		if *maskFile != "" {
+			var err error
+			mask, err = loadMask(*maskFile)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "mask")
+			}
+		}
+		// check the defaults are good before we start
+		if _, err := (params{defaults: defaults, mask: mask}).options(); err != nil {
+			return nil, nil, err
+		}
+		return defaults, mask, nil
+	}
+}
+
+// outputFlags adds the flags for the default output settings of images
+// to flags. Once the flags are parsed, call the function it returns to
+// add them to the defaults.
+func outputFlags(flags *flag.FlagSet) func(defaults map[string]string) error {
+	var (
+		format    = flags.String("format", "", "default output format (jpeg, png or gif; empty keeps the format of the source image)")
+		fallback  = flags.String("fallback", "png", "output format for source images in other formats, like WebP, BMP and TIFF")
+		quality   = flags.Int("quality", 90, "default JPEG quality (1-100)")
+		metadata  = flags.String("metadata", "strip", "default for what to do with JPEG metadata (strip, or keep it without location, maker notes or thumbnail)")
+		keyframes = flags.Int("keyframes", 1, "default for how often to find faces in animated GIFs (1 checks every frame, 2 every other frame and tracks faces in between, and so on)")
+	)
+	return func(defaults map[string]string) error {
+		defaults["format"] = *format
+		defaults["fallback"] = *fallback
+		defaults["quality"] = strconv.Itoa(*quality)
+		defaults["metadata"] = *metadata
+		defaults["keyframes"] = strconv.Itoa(*keyframes)
+		if _, err := (params{defaults: defaults}).options(); err != nil {
+			return err
+		}
+		if _, err := (params{defaults: defaults}).output("jpeg"); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// anonymise produces a new image with faces redacted, and a report of
+// what was done.
+// see https://becominghuman.ai/anonymising-images-with-go-and-machine-box-fd0866adb9f5
+func anonymise(src image.Image, found detections, opts options) (image.Image, report) {
+	dstImage := image.NewRGBA(src.Bounds())
+	draw.Draw(dstImage, src.Bounds(), src, image.ZP, draw.Src)
+	rep := opts.report(found, dstImage.Bounds())
+	for _, area := range rep.areas() {
+		opts.redact(dstImage, area)
+	}
+	return dstImage, rep
+}
+
+// loadMask loads the PNG image for the mask style.
+func loadMask(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
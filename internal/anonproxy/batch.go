@@ -0,0 +1,383 @@
+package anonproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// batchSummary describes the anonbatch command in help output.
+const batchSummary = "Anonymise every image in a directory tree"
+
+// BatchCommand is the anonbatch command.
+var BatchCommand = cli.Command{
+	Name:    "anonbatch",
+	Summary: batchSummary,
+	Run:     RunBatch,
+}
+
+// imageExts are the extensions of the files anonbatch anonymises.
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+	".webp": true,
+}
+
+// formatExts are the extensions of files written in each output format.
+var formatExts = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// RunBatch anonymises the images in the src directory, and writes them
+// to the same places in the out directory, each with a JSON report.
+func RunBatch(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("anonbatch", batchSummary+".")
+	var (
+		faceboxAddr = flags.String("facebox", "http://localhost:8080", "Facebox address")
+		settings    = redactionFlags(flags)
+		outSettings = outputFlags(flags)
+		restore     = restoreFlags(flags)
+		detectors   = detectorFlags(flags)
+		src         = flags.String("src", ".", "directory of images to anonymise")
+		out         = flags.String("out", "", "directory to write the anonymised images and reports to")
+		workers     = flags.Int("workers", 4, "number of images to anonymise at once")
+		force       = flags.Bool("force", false, "anonymise images again even if they haven't changed")
+	)
+	if ok, err := config.Parse("anonbatch", flags, args); !ok {
+		return err
+	}
+	if *out == "" {
+		return errors.New("out required")
+	}
+	if *workers < 1 {
+		return errors.New("workers must be at least 1")
+	}
+	defaults, mask, err := settings()
+	if err != nil {
+		return err
+	}
+	restoreKey, err := restore(defaults)
+	if err != nil {
+		return err
+	}
+	if err := outSettings(defaults); err != nil {
+		return err
+	}
+	b := &batch{force: *force}
+	if b.src, err = filepath.Abs(*src); err != nil {
+		return err
+	}
+	if b.out, err = filepath.Abs(*out); err != nil {
+		return err
+	}
+	if b.src == b.out {
+		return errors.New("out must be a different directory to src")
+	}
+	files, err := findImages(b.src, b.out)
+	if err != nil {
+		return err
+	}
+	b.index(files)
+	fb, err := cli.Facebox(ctx, *faceboxAddr)
+	if err != nil {
+		return err
+	}
+	ds, err := detectors(ctx)
+	if err != nil {
+		return err
+	}
+	// only the anonymising part of the server is needed
+	b.server = &server{fb: fb, detectors: ds, restoreKey: restoreKey, mask: mask}
+	b.params = params{defaults: defaults, mask: mask}
+	b.opts, err = b.params.options()
+	if err != nil {
+		return err
+	}
+	b.settings = b.params.values().Encode()
+	b.key = b.server.settingsKey()
+	fmt.Printf("anonymising %d images from %s to %s...\n", len(files), b.src, b.out)
+	bar := pb.StartNew(len(files))
+	var (
+		mu                          sync.Mutex
+		anonymised, skipped, failed int
+		wg                          sync.WaitGroup
+	)
+	paths := make(chan string)
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				done, err := b.anonymiseFile(path)
+				mu.Lock()
+				switch {
+				case err != nil:
+					failed++
+					log.Printf("%s: %v", path, err)
+				case done:
+					anonymised++
+				default:
+					skipped++
+				}
+				mu.Unlock()
+				bar.Increment()
+			}
+		}()
+	}
+	for _, path := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		paths <- path
+	}
+	close(paths)
+	wg.Wait()
+	bar.FinishPrint("anonymising complete")
+	fmt.Printf("Anonymised: %d\n", anonymised)
+	fmt.Printf("Unchanged:  %d\n", skipped)
+	fmt.Printf("Failed:     %d\n", failed)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d images failed", failed, len(files))
+	}
+	return nil
+}
+
+// batch anonymises the images in a directory tree.
+type batch struct {
+	server *server
+	params params
+	opts   options
+	// src and out are the absolute paths of the source and output
+	// directories.
+	src, out string
+	// settings are the encoded settings, and key identifies the
+	// settings that aren't parameters (see settingsKey), so images can
+	// be anonymised again if they change.
+	settings string
+	key      string
+	force    bool
+	// sources are the paths of the source images, and names counts
+	// them by path without the extension (lower case), to tell when
+	// changing an extension would write two images to the same place.
+	sources map[string]bool
+	names   map[string]int
+}
+
+// index records the paths of the source images.
+func (b *batch) index(paths []string) {
+	b.sources = make(map[string]bool)
+	b.names = make(map[string]int)
+	for _, path := range paths {
+		b.sources[strings.ToLower(path)] = true
+		b.names[strings.ToLower(strings.TrimSuffix(path, filepath.Ext(path)))]++
+	}
+}
+
+// outputPath gets the path to write the image at path to, in the
+// format. If the format changes, so does the extension, unless another
+// source image has the same name apart from its extension; then the
+// original extension is kept, so with a.png there too, a.bmp is written
+// to a.bmp.png.
+func (b *batch) outputPath(path, format string) (string, error) {
+	ext := filepath.Ext(path)
+	if normaliseFormat(strings.TrimPrefix(ext, ".")) == format {
+		return path, nil
+	}
+	name := strings.TrimSuffix(path, ext)
+	if b.names[strings.ToLower(name)] <= 1 {
+		return name + formatExts[format], nil
+	}
+	out := path + formatExts[format]
+	if b.sources[strings.ToLower(out)] {
+		return "", errors.New("output would overwrite another image: " + out)
+	}
+	return out, nil
+}
+
+// fileReport is the JSON report written next to each anonymised image.
+type fileReport struct {
+	// Source and Output are the paths of the images, relative to the
+	// source and output directories.
+	Source string `json:"source"`
+	Output string `json:"output,omitempty"`
+	// Restore is the path of the sidecar with the original faces,
+	// relative to the output directory.
+	Restore string `json:"restore,omitempty"`
+	// SHA256 is the hash of the source image.
+	SHA256 string `json:"sha256"`
+	// Settings are the settings the image was anonymised with, and
+	// Key identifies the mask, detectors and restore key.
+	Settings string  `json:"settings"`
+	Key      string  `json:"key"`
+	Error    string  `json:"error,omitempty"`
+	Report   *report `json:"report,omitempty"`
+}
+
+// anonymiseFile anonymises the image at path (relative to the source
+// directory), unless it has already been done with the same settings.
+// It reports whether the image was anonymised.
+func (b *batch) anonymiseFile(path string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.src, path))
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	fr := fileReport{
+		Source:   filepath.ToSlash(path),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Settings: b.settings,
+		Key:      b.key,
+	}
+	reportPath := filepath.Join(b.out, path+".json")
+	if !b.force && b.done(reportPath, fr) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(reportPath), 0755); err != nil {
+		return false, err
+	}
+	outPath, restorePath, rep, err := b.anonymise(data, path)
+	if err != nil {
+		fr.Error = err.Error()
+		if err := writeFileReport(reportPath, fr); err != nil {
+			log.Println(err)
+		}
+		return false, err
+	}
+	fr.Output = filepath.ToSlash(outPath)
+	if restorePath != "" {
+		fr.Restore = filepath.ToSlash(restorePath)
+	}
+	fr.Report = &rep
+	if err := writeFileReport(reportPath, fr); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// anonymise anonymises the image, and writes it to the output directory.
+// It returns the path the image was written to, relative to the output
+// directory, which has a different extension if the format changed (see
+// outputPath), and
+// the path of the sidecar with the original faces if there is one.
+func (b *batch) anonymise(data []byte, path string) (string, string, report, error) {
+	img, out, rep, err := b.server.anonymise(data, b.params, b.opts)
+	if err != nil {
+		return "", "", report{}, err
+	}
+	path, err = b.outputPath(path, out.format)
+	if err != nil {
+		return "", "", report{}, err
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, img, out); err != nil {
+		return "", "", report{}, err
+	}
+	if err := writeFile(filepath.Join(b.out, path), buf.Bytes(), 0644); err != nil {
+		return "", "", report{}, err
+	}
+	var restorePath string
+	if out.restore == "sidecar" {
+		restorePath = path + ".restore"
+		sealed, err := out.seal(buf.Bytes())
+		if err != nil {
+			return "", "", report{}, err
+		}
+		if err := writeFile(filepath.Join(b.out, restorePath), sealed, 0600); err != nil {
+			return "", "", report{}, err
+		}
+	}
+	return path, restorePath, rep, nil
+}
+
+// done checks whether the report at reportPath says the same image has
+// already been anonymised with the same settings, and the output (and
+// any sidecar) is still there.
+func (b *batch) done(reportPath string, fr fileReport) bool {
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		return false
+	}
+	var previous fileReport
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return false
+	}
+	if previous.Error != "" || previous.Output == "" {
+		return false
+	}
+	if previous.SHA256 != fr.SHA256 || previous.Settings != fr.Settings || previous.Key != fr.Key {
+		return false
+	}
+	for _, path := range []string{previous.Output, previous.Restore} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(b.out, filepath.FromSlash(path))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileReport writes the report as indented JSON.
+func writeFileReport(path string, fr fileReport) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(fr); err != nil {
+		return err
+	}
+	return writeFile(path, buf.Bytes(), 0644)
+}
+
+// findImages gets the paths of the images in the src directory tree,
+// relative to src. Hidden files and directories, and the out directory,
+// are skipped.
+func findImages(src, out string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != src && strings.HasPrefix(info.Name(), ".") || path == out {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !imageExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	return paths, err
+}
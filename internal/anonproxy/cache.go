@@ -0,0 +1,432 @@
+package anonproxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/machinebox/toys/signedurl"
+)
+
+// cacheEntry is a cached response.
+// Fields are exported so entries can be stored on disk.
+type cacheEntry struct {
+	// Body is the redacted image.
+	Body []byte
+	// Header are the headers to send with the image.
+	Header http.Header
+	// ETag identifies the redacted image.
+	ETag string
+	// Expires is when the source image must be checked again.
+	Expires time.Time
+	// SrcETag and SrcLastModified are the validators for the source
+	// image, used to check if it has changed.
+	SrcETag         string
+	SrcLastModified string
+
+	// noStore is set when the source may not be cached.
+	noStore bool
+}
+
+// fresh gets whether the entry can be used without checking the source.
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// cache holds redacted images in memory (least recently used are dropped
+// first) and optionally on disk.
+type cache struct {
+	// maxSize is the most bytes of images to keep in memory.
+	maxSize int64
+	// dir is the directory for the disk cache, if any.
+	dir string
+	// dirMaxSize is the most bytes to keep on disk, or zero for no
+	// limit. Least recently used files are removed first.
+	dirMaxSize int64
+	// dirMaxAge is how long files are kept on disk after they were
+	// last used, or zero for ever.
+	dirMaxAge time.Duration
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+	// dirSize is roughly how many bytes are on disk; it is counted
+	// properly by each sweep.
+	dirSize   int64
+	lastSweep time.Time
+	sweeping  bool
+}
+
+type cacheItem struct {
+	key   string
+	entry *cacheEntry
+}
+
+func newCache(maxSize int64, dir string) *cache {
+	return &cache{
+		maxSize: maxSize,
+		dir:     dir,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get gets the entry for the key, or false if there isn't one.
+func (c *cache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		entry := el.Value.(*cacheItem).entry
+		c.mu.Unlock()
+		return entry, true
+	}
+	c.mu.Unlock()
+	if c.dir == "" {
+		return nil, false
+	}
+	entry, err := c.readFile(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("cache:", err)
+		}
+		return nil, false
+	}
+	// mark it as used, so sweep keeps it
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	c.putMemory(key, entry)
+	return entry, true
+}
+
+// put adds or replaces the entry for the key.
+func (c *cache) put(key string, entry *cacheEntry) {
+	c.putMemory(key, entry)
+	if c.dir == "" {
+		return
+	}
+	if err := c.writeFile(key, entry); err != nil {
+		log.Println("cache:", err)
+		return
+	}
+	if c.sweepDue() {
+		go c.sweep()
+	}
+}
+
+func (c *cache) putMemory(key string, entry *cacheEntry) {
+	size := int64(len(entry.Body))
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.size -= int64(len(el.Value.(*cacheItem).entry.Body))
+		el.Value.(*cacheItem).entry = entry
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[key] = c.lru.PushFront(&cacheItem{key: key, entry: entry})
+	}
+	c.size += size
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		item := el.Value.(*cacheItem)
+		c.lru.Remove(el)
+		delete(c.items, item.key)
+		c.size -= int64(len(item.entry.Body))
+	}
+}
+
+func (c *cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+func (c *cache) readFile(key string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (c *cache) writeFile(key string, entry *cacheEntry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFile(path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.dirSize += int64(buf.Len())
+	c.mu.Unlock()
+	return nil
+}
+
+// sweepInterval is how often the disk cache is swept, when it isn't
+// over its size.
+const sweepInterval = time.Hour
+
+// sweepDue gets whether the disk cache should be swept, and if so, marks
+// it as being swept.
+func (c *cache) sweepDue() bool {
+	if c.dirMaxSize <= 0 && c.dirMaxAge <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sweeping {
+		return false
+	}
+	if (c.dirMaxSize > 0 && c.dirSize > c.dirMaxSize) || time.Since(c.lastSweep) > sweepInterval {
+		c.sweeping = true
+		return true
+	}
+	return false
+}
+
+// sweep removes files from the disk cache that haven't been used for
+// dirMaxAge, and then the least recently used files until it is under
+// dirMaxSize, with some room to spare.
+func (c *cache) sweep() {
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	now := time.Now()
+	var files []cacheFile
+	var total int64
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		tmp := strings.HasPrefix(info.Name(), ".tmp")
+		if tmp && now.Sub(info.ModTime()) < time.Hour {
+			// still being written
+			return nil
+		}
+		if tmp || (c.dirMaxAge > 0 && now.Sub(info.ModTime()) > c.dirMaxAge) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Println("cache:", err)
+	}
+	if c.dirMaxSize > 0 && total > c.dirMaxSize {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+		target := c.dirMaxSize / 10 * 9
+		for _, file := range files {
+			if total <= target {
+				break
+			}
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				log.Println("cache:", err)
+				continue
+			}
+			total -= file.size
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirSize = total
+	c.lastSweep = now
+	c.sweeping = false
+}
+
+// writeFile writes data to a temporary file and renames it to path, so
+// readers never see half a file.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// cacheKey gets the key for the src URL with the parameters and the
+// server's settings (see settingsKey).
+// Every parameter that is set contributes, so the same image redacted in
+// different ways is cached separately.
+func cacheKey(src string, p params, settings string) string {
+	key := src + "\n" + p.values().Encode() + "\n" + settings
+	if p.consent != nil {
+		// redact images again when someone's consent changes
+		key += "\n" + p.consent.version()
+	}
+	return key
+}
+
+// settingsKey identifies the settings that change redacted images but
+// aren't parameters: the mask image, the detectors (by their String
+// method, if they have one) and the restore key. It changes when any of
+// them do, so the disk cache isn't used after a restart with different
+// settings.
+func (s *server) settingsKey() string {
+	s.settingsOnce.Do(func() {
+		h := sha256.New()
+		if s.mask != nil {
+			bounds := s.mask.Bounds()
+			mask := image.NewRGBA(bounds)
+			draw.Draw(mask, bounds, s.mask, bounds.Min, draw.Src)
+			fmt.Fprintln(h, "mask", bounds)
+			h.Write(mask.Pix)
+		}
+		for _, d := range s.detectors {
+			if name, ok := d.(fmt.Stringer); ok {
+				fmt.Fprintln(h, "detector", name.String())
+				continue
+			}
+			fmt.Fprintf(h, "detector %T\n", d)
+		}
+		fmt.Fprintln(h, "restore", hex.EncodeToString(s.restoreKey))
+		s.settings = hex.EncodeToString(h.Sum(nil)[:16])
+	})
+	return s.settings
+}
+
+// values gets the effective settings, leaving out src and the
+// signature.
+func (p params) values() url.Values {
+	values := make(url.Values)
+	for key := range p.defaults {
+		values.Set(key, p.get(key))
+	}
+	for key := range p.query {
+		switch key {
+		case "src", signedurl.SignatureParam, signedurl.ExpiresParam:
+			continue
+		}
+		values.Set(key, p.get(key))
+	}
+	return values
+}
+
+// freshness gets how long a response with the header can be used
+// without checking with the source, and whether it may be stored at all.
+// Without caching headers, it is the ttl.
+func freshness(header http.Header, now time.Time, ttl time.Duration) (time.Duration, bool) {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["private"]; ok {
+		// we're a shared cache
+		return 0, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid means already expired
+			return 0, true
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		if t.Before(now) {
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+	return ttl, true
+}
+
+// parseCacheControl parses the directives in a Cache-Control header.
+func parseCacheControl(s string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.Index(part, "="); i != -1 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(name)] = value
+	}
+	return directives
+}
+
+// etagMatch gets whether the If-None-Match header value matches the etag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// makeETag makes a strong ETag for the body.
+func makeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
@@ -0,0 +1,255 @@
+package anonproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Consent statuses.
+const (
+	// consentGiven is for people who are happy to be shown in images.
+	consentGiven = "given"
+	// consentRefused is for people who have opted out, so they're
+	// always redacted.
+	consentRefused = "refused"
+)
+
+// consentRecord is whether someone recognised by Facebox has agreed to
+// be shown in images.
+type consentRecord struct {
+	// ID is the Facebox ID of the person.
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Consent string    `json:"consent"`
+	Updated time.Time `json:"updated"`
+}
+
+// consentFile is the JSON file the registry is kept in.
+type consentFile struct {
+	Updated time.Time       `json:"updated"`
+	People  []consentRecord `json:"people"`
+}
+
+// consentRegistry records who has given or refused consent, keyed by
+// Facebox ID, and keeps it in a JSON file.
+// A nil registry is empty.
+type consentRegistry struct {
+	path string
+
+	mu      sync.RWMutex
+	people  map[string]consentRecord
+	updated time.Time
+}
+
+// loadConsent loads the registry from the file at path, which is
+// created when the registry first changes.
+func loadConsent(path string) (*consentRegistry, error) {
+	c := &consentRegistry{path: path, people: make(map[string]consentRecord)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "consent")
+	}
+	var file consentFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, errors.Wrap(err, "consent: "+path)
+	}
+	c.updated = file.Updated
+	for _, person := range file.People {
+		c.people[person.ID] = person
+	}
+	return c, nil
+}
+
+// status gets the consent status of the person with the Facebox ID, or
+// an empty string if they aren't in the registry.
+func (c *consentRegistry) status(id string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.people[id].Consent
+}
+
+// version changes whenever the registry changes, so images redacted
+// before the change aren't used.
+func (c *consentRegistry) version() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.updated.UTC().Format(time.RFC3339Nano)
+}
+
+// get gets the record for the Facebox ID.
+func (c *consentRegistry) get(id string) (consentRecord, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	person, ok := c.people[id]
+	return person, ok
+}
+
+// list gets everyone in the registry, in ID order.
+func (c *consentRegistry) list() []consentRecord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	people := make([]consentRecord, 0, len(c.people))
+	for _, person := range c.people {
+		people = append(people, person)
+	}
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].ID < people[j].ID
+	})
+	return people
+}
+
+// set adds or updates the record for a person.
+func (c *consentRegistry) set(person consentRecord) (consentRecord, error) {
+	if person.ID == "" {
+		return person, errors.New("consent: id required")
+	}
+	if person.Consent != consentGiven && person.Consent != consentRefused {
+		return person, errors.New("consent: expected " + consentGiven + " or " + consentRefused)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, existed := c.people[person.ID]
+	person.Updated = c.now()
+	c.people[person.ID] = person
+	if err := c.save(); err != nil {
+		if existed {
+			c.people[person.ID] = previous
+		} else {
+			delete(c.people, person.ID)
+		}
+		return person, err
+	}
+	return person, nil
+}
+
+// remove removes a person from the registry, and reports whether they
+// were in it.
+func (c *consentRegistry) remove(id string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	person, ok := c.people[id]
+	if !ok {
+		return false, nil
+	}
+	delete(c.people, id)
+	c.now()
+	if err := c.save(); err != nil {
+		c.people[id] = person
+		return false, err
+	}
+	return true, nil
+}
+
+// now marks the registry as updated, and gets the time. The time always
+// moves on, so the version changes even if the clock doesn't.
+func (c *consentRegistry) now() time.Time {
+	now := time.Now().UTC()
+	if !now.After(c.updated) {
+		now = c.updated.Add(time.Nanosecond)
+	}
+	c.updated = now
+	return now
+}
+
+// save writes the registry to its file. The lock must be held.
+func (c *consentRegistry) save() error {
+	file := consentFile{Updated: c.updated, People: make([]consentRecord, 0, len(c.people))}
+	for _, person := range c.people {
+		file.People = append(file.People, person)
+	}
+	sort.Slice(file.People, func(i, j int) bool {
+		return file.People[i].ID < file.People[j].ID
+	})
+	b, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFile(c.path, b, 0600), "consent")
+}
+
+// consentAPI is the admin API for the consent registry:
+//
+//	GET    /consent       lists everyone
+//	GET    /consent/{id}  gets someone
+//	PUT    /consent/{id}  sets someone's consent, like {"name":"Alice","consent":"refused"}
+//	DELETE /consent/{id}  removes someone
+//
+// IDs are Facebox IDs, escaped if they have slashes in.
+func consentAPI(c *consentRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consent", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "GET the registry", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, struct {
+			People []consentRecord `json:"people"`
+		}{People: c.list()})
+	})
+	mux.HandleFunc("/consent/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/consent/"))
+		if err != nil || id == "" {
+			http.Error(w, "id: bad or missing", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			person, ok := c.get(id)
+			if !ok {
+				http.Error(w, "not in the registry: "+strconv.Quote(id), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, person)
+		case http.MethodPut:
+			var person consentRecord
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&person); err != nil {
+				http.Error(w, errors.Wrap(err, "json").Error(), http.StatusBadRequest)
+				return
+			}
+			person.ID = id
+			person.Consent = strings.ToLower(person.Consent)
+			if person.Consent != consentGiven && person.Consent != consentRefused {
+				http.Error(w, "consent: expected "+consentGiven+" or "+consentRefused, http.StatusBadRequest)
+				return
+			}
+			person, err := c.set(person)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, person)
+		case http.MethodDelete:
+			ok, err := c.remove(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "not in the registry: "+strconv.Quote(id), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "GET, PUT or DELETE someone", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,159 @@
+package anonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestConsentRegistry(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "consent.json")
+
+	c, err := loadConsent(path)
+	is.NoErr(err)
+	is.Equal(len(c.list()), 0)
+	is.Equal(c.status("alice"), "")
+	version := c.version()
+
+	_, err = c.set(consentRecord{ID: "alice", Name: "Alice", Consent: consentRefused})
+	is.NoErr(err)
+	_, err = c.set(consentRecord{ID: "bob", Consent: consentGiven})
+	is.NoErr(err)
+	_, err = c.set(consentRecord{ID: "carol", Consent: "maybe"})
+	is.True(err != nil)
+	is.Equal(c.status("alice"), consentRefused)
+	is.Equal(c.status("bob"), consentGiven)
+	is.True(c.version() != version)
+
+	// it's all still there after a restart
+	c, err = loadConsent(path)
+	is.NoErr(err)
+	people := c.list()
+	is.Equal(len(people), 2)
+	is.Equal(people[0].ID, "alice")
+	is.Equal(people[0].Name, "Alice")
+	is.Equal(people[1].ID, "bob")
+
+	version = c.version()
+	ok, err := c.remove("alice")
+	is.NoErr(err)
+	is.True(ok)
+	ok, err = c.remove("alice")
+	is.NoErr(err)
+	is.True(!ok)
+	is.Equal(c.status("alice"), "")
+	is.True(c.version() != version)
+
+	var nothing *consentRegistry
+	is.Equal(nothing.status("bob"), "")
+}
+
+func TestConsentAPI(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	c, err := loadConsent(filepath.Join(dir, "consent.json"))
+	is.NoErr(err)
+	api := consentAPI(c)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := do("PUT", "/consent/"+url.PathEscape("staff/alice.jpg"), `{"name":"Alice","consent":"refused"}`)
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(c.status("staff/alice.jpg"), consentRefused)
+	w = do("PUT", "/consent/bob", `{"consent":"sometimes"}`)
+	is.Equal(w.Code, http.StatusBadRequest)
+	w = do("PUT", "/consent/bob", `not json`)
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	w = do("GET", "/consent/"+url.PathEscape("staff/alice.jpg"), "")
+	is.Equal(w.Code, http.StatusOK)
+	var person consentRecord
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &person))
+	is.Equal(person.ID, "staff/alice.jpg")
+	is.Equal(person.Name, "Alice")
+	is.Equal(person.Consent, consentRefused)
+	w = do("GET", "/consent/bob", "")
+	is.Equal(w.Code, http.StatusNotFound)
+
+	w = do("GET", "/consent", "")
+	is.Equal(w.Code, http.StatusOK)
+	var registry struct {
+		People []consentRecord `json:"people"`
+	}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &registry))
+	is.Equal(len(registry.People), 1)
+
+	w = do("DELETE", "/consent/"+url.PathEscape("staff/alice.jpg"), "")
+	is.Equal(w.Code, http.StatusNoContent)
+	w = do("DELETE", "/consent/"+url.PathEscape("staff/alice.jpg"), "")
+	is.Equal(w.Code, http.StatusNotFound)
+	w = do("POST", "/consent/bob", "")
+	is.Equal(w.Code, http.StatusMethodNotAllowed)
+}
+
+func TestConsentRedaction(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.overrides = true
+	s.consent, err = loadConsent(filepath.Join(dir, "consent.json"))
+	is.NoErr(err)
+	redacted := func(query string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/faces?"+query, bytes.NewReader(encodeTest(t, "png"))))
+		is.Equal(w.Code, http.StatusOK)
+		var rep report
+		is.NoErr(json.Unmarshal(w.Body.Bytes(), &rep))
+		return rep.Redacted
+	}
+
+	is.Equal(redacted("redact=except&allow=alice"), 1)
+	is.Equal(redacted("redact=consented"), 2) // alice hasn't given consent
+	_, err = s.consent.set(consentRecord{ID: "alice", Consent: consentGiven})
+	is.NoErr(err)
+	is.Equal(redacted("redact=consented"), 1)
+	_, err = s.consent.set(consentRecord{ID: "alice", Consent: consentRefused})
+	is.NoErr(err)
+	is.Equal(redacted("redact=except&allow=alice"), 2)
+	is.Equal(redacted("redact=unmatched"), 2)
+
+	// cached images are redacted again when consent changes
+	s.cache = newCache(1<<20, "")
+	s.cacheTTL = time.Minute
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/?redact=unmatched&src="+url.QueryEscape(src.URL+"/test.png"), nil))
+		is.Equal(w.Code, http.StatusOK)
+		return w
+	}
+	is.Equal(get().Header().Get("X-Cache"), "MISS")
+	is.Equal(get().Header().Get("X-Cache"), "HIT")
+	_, err = s.consent.set(consentRecord{ID: "alice", Consent: consentGiven})
+	is.NoErr(err)
+	is.Equal(get().Header().Get("X-Cache"), "MISS")
+}
@@ -0,0 +1,245 @@
+package anonproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/machinebox/sdk-go/objectbox"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+)
+
+// Detector finds things other than faces that give people away, like
+// licence plates and signs, so they can be redacted too.
+type Detector interface {
+	// Detect finds the objects in an image (JPEG, PNG or GIF).
+	Detect(image []byte) ([]Object, error)
+}
+
+// Object is something a Detector found in an image.
+type Object struct {
+	// Label says what the object is, like plate or text.
+	Label      string
+	Confidence float64
+	Rect       image.Rectangle
+}
+
+// detections are the faces and objects found in an image.
+type detections struct {
+	faces   []facebox.Face
+	objects []Object
+}
+
+// detect finds objects in the image with the detectors.
+func (s *server) detect(data []byte) ([]Object, error) {
+	if len(s.detectors) == 0 {
+		return nil, nil
+	}
+	defer observe("detect", time.Now())
+	var objects []Object
+	for _, d := range s.detectors {
+		found, err := d.Detect(data)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, found...)
+	}
+	return objects, nil
+}
+
+// detectAll finds the faces and objects in the image.
+func (s *server) detectAll(data []byte) (detections, error) {
+	faces, err := s.check(data)
+	if err != nil {
+		return detections{}, errors.Wrap(err, "facebox")
+	}
+	objects, err := s.detect(data)
+	if err != nil {
+		return detections{}, errors.Wrap(err, "detect")
+	}
+	return detections{faces: faces, objects: objects}, nil
+}
+
+// objectboxDetector finds objects with Objectbox. The labels are the
+// tags of Objectbox's detectors.
+type objectboxDetector struct {
+	addr   string
+	client *objectbox.Client
+}
+
+func (d objectboxDetector) String() string {
+	return "objectbox " + d.addr
+}
+
+func (d objectboxDetector) Detect(b []byte) ([]Object, error) {
+	res, err := d.client.Check(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "objectbox")
+	}
+	var objects []Object
+	for _, detector := range res.Detectors {
+		for _, tag := range detector.Tags {
+			objects = append(objects, Object{
+				Label:      tag.Tag,
+				Confidence: tag.Confidence,
+				Rect: image.Rect(
+					tag.Rect.Left,
+					tag.Rect.Top,
+					tag.Rect.Left+tag.Rect.Width,
+					tag.Rect.Top+tag.Rect.Height,
+				),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// httpDetector finds objects with any HTTP service, like a local licence
+// plate reader. The image is POSTed to the URL, which responds with
+// JSON like:
+//
+//	{"objects":[{"label":"plate","confidence":0.9,"rect":{"top":10,"left":20,"width":100,"height":30}}]}
+type httpDetector struct {
+	url    string
+	client *http.Client
+}
+
+func (d httpDetector) String() string {
+	return "detector " + d.url
+}
+
+func (d httpDetector) Detect(b []byte) ([]Object, error) {
+	resp, err := d.client.Post(d.url, http.DetectContentType(b), bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "detector")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errors.New("detector: " + resp.Status)
+	}
+	var res struct {
+		Objects []struct {
+			Label      string  `json:"label"`
+			Confidence float64 `json:"confidence"`
+			Rect       rect    `json:"rect"`
+		} `json:"objects"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "detector: decoding response")
+	}
+	objects := make([]Object, len(res.Objects))
+	for i, o := range res.Objects {
+		objects[i] = Object{
+			Label:      o.Label,
+			Confidence: o.Confidence,
+			Rect:       image.Rect(o.Rect.Left, o.Rect.Top, o.Rect.Left+o.Rect.Width, o.Rect.Top+o.Rect.Height),
+		}
+	}
+	return objects, nil
+}
+
+// detectorFlags adds the flags for the detectors to flags. Once the flags
+// are parsed, call the function it returns to connect to them.
+func detectorFlags(flags *flag.FlagSet) func(ctx context.Context) ([]Detector, error) {
+	var (
+		objectboxAddr = flags.String("objectbox", "", "Objectbox address, to also redact the objects it finds (see -labels)")
+		detectorURL   = flags.String("detector", "", "URL to POST images to, to also redact the objects an HTTP service finds (see -labels)")
+	)
+	return func(ctx context.Context) ([]Detector, error) {
+		var detectors []Detector
+		if *objectboxAddr != "" {
+			ob, err := cli.Objectbox(ctx, *objectboxAddr)
+			if err != nil {
+				return nil, err
+			}
+			detectors = append(detectors, objectboxDetector{addr: *objectboxAddr, client: ob})
+			fmt.Println("Objectbox at", *objectboxAddr)
+		}
+		if *detectorURL != "" {
+			detectors = append(detectors, httpDetector{
+				url:    *detectorURL,
+				client: &http.Client{Timeout: time.Minute},
+			})
+		}
+		return detectors, nil
+	}
+}
+
+// interpolate estimates the faces and objects t (0 to 1) of the way
+// between two frames.
+func interpolate(a, b detections, t float64) detections {
+	return detections{
+		faces:   interpolateFaces(a.faces, b.faces, t),
+		objects: interpolateObjects(a.objects, b.objects, t),
+	}
+}
+
+// paired gets whether every face and object in a can be paired with one
+// in b, and the other way round, so interpolating between them follows
+// everything. Otherwise something moved too far, or came or went, and
+// the frames in between need checking.
+func paired(a, b detections) bool {
+	faceRects := func(faces []facebox.Face) []image.Rectangle {
+		rects := make([]image.Rectangle, len(faces))
+		for i := range faces {
+			rects[i] = faceRect(faces[i])
+		}
+		return rects
+	}
+	objectRects := func(objects []Object) []image.Rectangle {
+		rects := make([]image.Rectangle, len(objects))
+		for i := range objects {
+			rects[i] = objects[i].Rect
+		}
+		return rects
+	}
+	pairs := pairRects(faceRects(a.faces), faceRects(b.faces), nil)
+	pairs = append(pairs, pairRects(objectRects(a.objects), objectRects(b.objects), func(i, j int) bool {
+		return a.objects[i].Label == b.objects[j].Label
+	})...)
+	for _, p := range pairs {
+		if p.i == -1 || p.j == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// interpolateObjects is like interpolateFaces, but only pairs objects
+// with the same label.
+func interpolateObjects(a, b []Object, t float64) []Object {
+	rectsA := make([]image.Rectangle, len(a))
+	for i := range a {
+		rectsA[i] = a[i].Rect
+	}
+	rectsB := make([]image.Rectangle, len(b))
+	for j := range b {
+		rectsB[j] = b[j].Rect
+	}
+	var objects []Object
+	for _, p := range pairRects(rectsA, rectsB, func(i, j int) bool {
+		return a[i].Label == b[j].Label
+	}) {
+		switch {
+		case p.j == -1:
+			objects = append(objects, a[p.i])
+		case p.i == -1:
+			objects = append(objects, b[p.j])
+		default:
+			object := a[p.i]
+			object.Rect = lerpRect(a[p.i].Rect, b[p.j].Rect, t)
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
@@ -0,0 +1,286 @@
+package anonproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// EXIF tags that matter here.
+const (
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagMakerNote        = 0x927c
+	tagThumbnailOffset  = 0x0201
+	tagThumbnailLength  = 0x0202
+	exifHeader          = "Exif\x00\x00"
+	maxJPEGSegmentBytes = 0xffff - 2
+)
+
+// jpegExif gets the EXIF data (a TIFF structure) from a JPEG image, or nil
+// if there isn't any.
+func jpegExif(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return nil
+		}
+		marker := b[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan or end of image; no more metadata
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if length < 2 || i+2+length > len(b) {
+			return nil
+		}
+		segment := b[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte(exifHeader)) {
+			return segment[len(exifHeader):]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// tiff reads the IFDs in a TIFF structure, as used by EXIF.
+// Reads out of range are zero, so damaged data can't cause panics.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+func newTIFF(b []byte) (*tiff, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+	t := &tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	return t, true
+}
+
+func (t *tiff) u16(off int) int {
+	if off < 0 || off+2 > len(t.b) {
+		return 0
+	}
+	return int(t.order.Uint16(t.b[off:]))
+}
+
+func (t *tiff) u32(off int) int {
+	if off < 0 || off+4 > len(t.b) {
+		return 0
+	}
+	return int(t.order.Uint32(t.b[off:]))
+}
+
+func (t *tiff) putU16(off, v int) {
+	if off >= 0 && off+2 <= len(t.b) {
+		t.order.PutUint16(t.b[off:], uint16(v))
+	}
+}
+
+func (t *tiff) putU32(off, v int) {
+	if off >= 0 && off+4 <= len(t.b) {
+		t.order.PutUint32(t.b[off:], uint32(v))
+	}
+}
+
+// zero clears n bytes at off.
+func (t *tiff) zero(off, n int) {
+	for i := off; i < off+n && i < len(t.b); i++ {
+		if i >= 0 {
+			t.b[i] = 0
+		}
+	}
+}
+
+// ifd0 gets the offset of the first IFD.
+func (t *tiff) ifd0() int {
+	return t.u32(4)
+}
+
+// entries gets the offsets of the 12 byte entries in the IFD at off.
+func (t *tiff) entries(off int) []int {
+	n := t.u16(off)
+	if off <= 0 || off+2+n*12 > len(t.b) {
+		return nil
+	}
+	entries := make([]int, n)
+	for i := range entries {
+		entries[i] = off + 2 + i*12
+	}
+	return entries
+}
+
+// find gets the offset of the entry with the tag in the IFD at off, or -1.
+func (t *tiff) find(off, tag int) int {
+	for _, entry := range t.entries(off) {
+		if t.u16(entry) == tag {
+			return entry
+		}
+	}
+	return -1
+}
+
+// value gets the offset and size of the value of an entry.
+func (t *tiff) value(entry int) (int, int) {
+	sizes := map[int]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+	size := sizes[t.u16(entry+2)] * t.u32(entry+4)
+	if size <= 4 {
+		return entry + 8, size
+	}
+	return t.u32(entry + 8), size
+}
+
+// wipeIFD zeroes the IFD at off, and the values it points to, and leaves
+// it empty.
+func (t *tiff) wipeIFD(off int) {
+	if off <= 0 {
+		return
+	}
+	entries := t.entries(off)
+	for _, entry := range entries {
+		valueOff, size := t.value(entry)
+		t.zero(valueOff, size)
+		t.zero(entry, 12)
+	}
+	t.putU16(off, 0)
+	if len(entries) > 0 {
+		// the next IFD offset follows the entries; move it up
+		next := t.u32(off + 2 + len(entries)*12)
+		t.zero(off+2+len(entries)*12, 4)
+		t.putU32(off+2, next)
+	}
+}
+
+// exifOrientation gets the orientation (1 to 8) from EXIF data, or 1.
+func exifOrientation(exif []byte) int {
+	t, ok := newTIFF(exif)
+	if !ok {
+		return 1
+	}
+	entry := t.find(t.ifd0(), tagOrientation)
+	if entry == -1 {
+		return 1
+	}
+	o := t.u16(entry + 8)
+	if o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// sanitiseExif gets a copy of the EXIF data that is safe to keep in a
+// redacted image. It has no GPS location, no maker notes (which can
+// hold previews) and no thumbnail (which would show the faces), and the
+// orientation is reset since the image has been turned the right way up.
+// It returns nil if the data can't be understood.
+func sanitiseExif(exif []byte) []byte {
+	t, ok := newTIFF(append([]byte(nil), exif...))
+	if !ok {
+		return nil
+	}
+	ifd0 := t.ifd0()
+	if t.entries(ifd0) == nil {
+		return nil
+	}
+	if entry := t.find(ifd0, tagOrientation); entry != -1 {
+		t.putU16(entry+8, 1)
+	}
+	if entry := t.find(ifd0, tagGPSIFD); entry != -1 {
+		t.wipeIFD(t.u32(entry + 8))
+	}
+	if entry := t.find(ifd0, tagExifIFD); entry != -1 {
+		if note := t.find(t.u32(entry+8), tagMakerNote); note != -1 {
+			valueOff, size := t.value(note)
+			t.zero(valueOff, size)
+		}
+	}
+	// IFD1 is the thumbnail
+	nextOff := ifd0 + 2 + len(t.entries(ifd0))*12
+	if ifd1 := t.u32(nextOff); ifd1 != 0 {
+		thumb := t.find(ifd1, tagThumbnailOffset)
+		length := t.find(ifd1, tagThumbnailLength)
+		if thumb != -1 && length != -1 {
+			t.zero(t.u32(thumb+8), t.u32(length+8))
+		}
+		t.wipeIFD(ifd1)
+		t.putU32(nextOff, 0)
+	}
+	return t.b
+}
+
+// encodeJPEGWithExif encodes img as a JPEG, with the EXIF data.
+func encodeJPEGWithExif(w io.Writer, img image.Image, quality int, exif []byte) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	if len(exifHeader)+len(exif) > maxJPEGSegmentBytes {
+		// too big to fit; leave it out
+		_, err := w.Write(b)
+		return err
+	}
+	// APP1 segment straight after the start of image marker
+	segment := make([]byte, 4, 4+len(exifHeader)+len(exif))
+	segment[0], segment[1] = 0xff, 0xe1
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+len(exif)))
+	segment = append(segment, exifHeader...)
+	segment = append(segment, exif...)
+	for _, part := range [][]byte{b[:2], segment, b[2:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orient turns img the right way up for the EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // flipped horizontally
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs turning anticlockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
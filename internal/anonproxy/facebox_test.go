@@ -0,0 +1,110 @@
+package anonproxy
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/machinebox/sdk-go/facebox"
+)
+
+// fakeFacebox is a Facebox that finds the same faces in every image.
+type fakeFacebox struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	faces []facebox.Face
+	// status, if set, is the status checks fail with.
+	status int
+	// checks is the number of images checked.
+	checks int
+}
+
+// newFakeFacebox starts a fake Facebox that finds the faces. Close it
+// when done.
+func newFakeFacebox(faces ...facebox.Face) *fakeFacebox {
+	fb := &fakeFacebox{faces: faces}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", fb.handleInfo)
+	mux.HandleFunc("/facebox/check", fb.handleCheck)
+	fb.Server = httptest.NewServer(mux)
+	return fb
+}
+
+// client gets a Facebox client for the fake.
+func (fb *fakeFacebox) client() *facebox.Client {
+	return facebox.New(fb.URL)
+}
+
+// fail makes checks fail with the status.
+func (fb *fakeFacebox) fail(status int) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.status = status
+}
+
+// checked gets the number of images checked.
+func (fb *fakeFacebox) checked() int {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.checks
+}
+
+func (fb *fakeFacebox) handleInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"name":    "facebox",
+		"version": 1,
+		"build":   "fake",
+		"status":  "ready",
+	})
+}
+
+func (fb *fakeFacebox) handleCheck(w http.ResponseWriter, r *http.Request) {
+	fb.mu.Lock()
+	fb.checks++
+	faces, status := fb.faces, fb.status
+	fb.mu.Unlock()
+	if status != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   http.StatusText(status),
+		})
+		return
+	}
+	// like Facebox, only accept images
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	if _, _, err := image.Decode(f); err != nil {
+		writeJSON(w, map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"success":    true,
+		"facesCount": len(faces),
+		"faces":      faces,
+	})
+}
+
+// face makes a face at the rectangle, recognised if name isn't empty.
+func face(left, top, width, height int, name string) facebox.Face {
+	return facebox.Face{
+		Rect: facebox.Rect{
+			Top:    top,
+			Left:   left,
+			Width:  width,
+			Height: height,
+		},
+		ID:         name,
+		Name:       name,
+		Matched:    name != "",
+		Confidence: 0.8,
+	}
+}
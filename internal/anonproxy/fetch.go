@@ -0,0 +1,316 @@
+package anonproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// blockedNetworks are the addresses the fetcher won't connect to unless
+// private addresses are allowed; loopback, private, link-local (including
+// cloud metadata services) and other special purpose ranges.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// maxRedirects is how many redirects the fetcher will follow.
+const maxRedirects = 5
+
+// fetcher downloads source images, refusing anything that might let
+// callers reach places they shouldn't.
+type fetcher struct {
+	client *http.Client
+	// schemes are the allowed URL schemes.
+	schemes map[string]bool
+	// allowHosts, if not empty, are the only hosts that may be fetched.
+	allowHosts []string
+	// denyHosts are hosts that may not be fetched.
+	denyHosts []string
+	// allowPrivate allows loopback, private and link-local addresses.
+	allowPrivate bool
+	// maxSize is the largest download in bytes.
+	maxSize int64
+}
+
+// fetcherOptions configure a fetcher.
+type fetcherOptions struct {
+	schemes      string
+	allowHosts   string
+	denyHosts    string
+	allowPrivate bool
+	maxSize      int64
+	timeout      time.Duration
+}
+
+func newFetcher(opts fetcherOptions) *fetcher {
+	f := &fetcher{
+		schemes:      make(map[string]bool),
+		allowHosts:   splitList(opts.allowHosts),
+		denyHosts:    splitList(opts.denyHosts),
+		allowPrivate: opts.allowPrivate,
+		maxSize:      opts.maxSize,
+	}
+	for _, scheme := range splitList(opts.schemes) {
+		f.schemes[scheme] = true
+	}
+	dialer := &net.Dialer{
+		Timeout: opts.timeout,
+		// check the address after it has been resolved, so DNS
+		// can't be used to sneak past
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := f.checkAddr(address); err != nil {
+				return statusError{http.StatusForbidden, err}
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: opts.timeout,
+		Transport: &http.Transport{
+			// no proxy, otherwise we'd only check the proxy address
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: opts.timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return statusError{http.StatusBadGateway, errors.New("too many redirects")}
+			}
+			if err := f.checkURL(req.URL); err != nil {
+				return statusError{http.StatusForbidden, errors.Wrap(err, "redirect")}
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// download is a downloaded source image.
+type download struct {
+	body   []byte
+	header http.Header
+	// notModified is true when the image hasn't changed since the
+	// copy with the ETag or Last-Modified given to get.
+	notModified bool
+}
+
+// fetch downloads the src URL.
+func (f *fetcher) fetch(ctx context.Context, src string) ([]byte, error) {
+	d, err := f.get(ctx, src, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return d.body, nil
+}
+
+// get downloads the src URL, unless it is unchanged since the copy with
+// the etag or lastModified (either may be empty).
+func (f *fetcher) get(ctx context.Context, src, etag, lastModified string) (*download, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, statusError{http.StatusBadRequest, errors.Wrap(err, "src")}
+	}
+	if !u.IsAbs() {
+		return nil, statusError{http.StatusBadRequest, errors.New("src: absolute url required")}
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, statusError{http.StatusForbidden, errors.Wrap(err, "src")}
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, statusError{http.StatusBadRequest, errors.Wrap(err, "src")}
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, requestError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "") {
+		return &download{header: resp.Header, notModified: true}, nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// there's no image at src
+		return nil, statusError{http.StatusNotFound, errors.New("download failed: " + resp.Status)}
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		// the source is broken, not the proxy
+		return nil, statusError{http.StatusBadGateway, errors.New("download failed: " + resp.Status)}
+	}
+	if f.maxSize > 0 && resp.ContentLength > f.maxSize {
+		return nil, statusError{http.StatusRequestEntityTooLarge, f.tooLarge()}
+	}
+	var body io.Reader = resp.Body
+	if f.maxSize > 0 {
+		// read one more byte than allowed to tell if there's too much
+		body = io.LimitReader(resp.Body, f.maxSize+1)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, requestError(err)
+	}
+	if f.maxSize > 0 && int64(len(b)) > f.maxSize {
+		return nil, statusError{http.StatusRequestEntityTooLarge, f.tooLarge()}
+	}
+	return &download{body: b, header: resp.Header}, nil
+}
+
+// requestError gets the error to respond with when downloading a source
+// image fails: the status the fetcher chose, 504 Gateway Timeout if the
+// source was too slow, or otherwise 502 Bad Gateway.
+func requestError(err error) error {
+	var status statusError
+	if errors.As(err, &status) {
+		return statusError{status.code, errors.Wrap(status.err, "download failed")}
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return statusError{http.StatusGatewayTimeout, errors.Wrap(err, "download failed")}
+	}
+	return statusError{http.StatusBadGateway, errors.Wrap(err, "download failed")}
+}
+
+func (f *fetcher) tooLarge() error {
+	return errors.New("download failed: larger than " + strconv.FormatInt(f.maxSize, 10) + " bytes")
+}
+
+// checkURL checks the scheme and host of u are allowed.
+func (f *fetcher) checkURL(u *url.URL) error {
+	if !f.schemes[strings.ToLower(u.Scheme)] {
+		return errors.New("scheme not allowed: " + u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if matchHost(f.denyHosts, host) {
+		return errors.New("host not allowed: " + host)
+	}
+	if len(f.allowHosts) > 0 && !matchHost(f.allowHosts, host) {
+		return errors.New("host not allowed: " + host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !f.allowPrivate && blocked(ip) {
+		return errors.New("address not allowed: " + host)
+	}
+	return nil
+}
+
+// checkAddr checks the resolved address (host:port) may be connected to.
+func (f *fetcher) checkAddr(address string) error {
+	if f.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("bad address: " + address)
+	}
+	if blocked(ip) {
+		return errors.New("address not allowed: " + host)
+	}
+	return nil
+}
+
+// blocked gets whether ip is in one of the blockedNetworks.
+func blocked(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost gets whether host matches any of the patterns. A pattern
+// matches the host exactly, or, if it starts with "*.", any subdomain.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// statusError is an error with the HTTP status code to respond with.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e statusError) Error() string {
+	return e.err.Error()
+}
+
+// errorStatus gets the HTTP status code for err.
+func errorStatus(err error) int {
+	if err, ok := errors.Cause(err).(statusError); ok {
+		return err.code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,122 @@
+package anonproxy
+
+import (
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	// more formats that can be decoded
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// formats are the supported output formats, and their content types.
+// Images in other formats (like WebP, BMP and TIFF) are output in the
+// fallback format.
+var formats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// output describes how to encode the redacted image.
+type output struct {
+	format string
+	// quality is the JPEG quality (1-100).
+	quality int
+	// exif is the EXIF metadata to keep in JPEG images, or nil to
+	// strip it.
+	exif []byte
+	// restore is how the original faces are kept so the image can be
+	// deanonymised (see restoreModes), or empty to not keep them.
+	restore string
+	// original is the original faces (see keepOriginal), and
+	// restoreKey the key to seal them with once the image is encoded.
+	original   []byte
+	restoreKey []byte
+}
+
+// output gets the output settings for an image in srcFormat.
+func (p params) output(srcFormat string) (output, error) {
+	out := output{format: srcFormat}
+	if f := p.get("format"); f != "" {
+		out.format = f
+	}
+	out.format = normaliseFormat(out.format)
+	if _, ok := formats[out.format]; !ok {
+		fallback := normaliseFormat(p.get("fallback"))
+		if p.get("format") != "" || fallback == "" {
+			return out, errors.New("unsupported format: " + strconv.Quote(out.format))
+		}
+		out.format = fallback
+		if _, ok := formats[out.format]; !ok {
+			return out, errors.New("fallback: unsupported format: " + strconv.Quote(out.format))
+		}
+	}
+	var err error
+	if out.quality, err = p.int("quality"); err != nil {
+		return out, err
+	}
+	if out.quality == 0 {
+		out.quality = jpeg.DefaultQuality
+	}
+	if out.quality < 1 || out.quality > 100 {
+		return out, errors.New("quality must be between 1 and 100")
+	}
+	switch p.get("metadata") {
+	case "", "strip", "keep":
+	default:
+		return out, errors.New("metadata: expected strip or keep")
+	}
+	out.restore = p.get("restore")
+	if out.restore != "" && !restoreModes[out.restore] {
+		return out, errors.New("restore: expected png or sidecar")
+	}
+	if out.restore == "png" && out.format != "png" {
+		return out, errors.New("restore: png needs the png format")
+	}
+	return out, nil
+}
+
+// seal encrypts the original faces for the encoded image.
+func (out output) seal(encoded []byte) ([]byte, error) {
+	return sealRestore(out.restoreKey, out.original, encoded)
+}
+
+// normaliseFormat turns names like jpg and image/png into format names.
+func normaliseFormat(format string) string {
+	format = strings.TrimPrefix(strings.ToLower(format), "image/")
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// encode writes img to w.
+func encode(w io.Writer, img image.Image, out output) error {
+	switch out.format {
+	case "jpeg":
+		if out.exif == nil {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: out.quality})
+		}
+		return encodeJPEGWithExif(w, img, out.quality, out.exif)
+	case "gif":
+		if anim, ok := img.(*animation); ok {
+			return gif.EncodeAll(w, anim.gif)
+		}
+		return gif.Encode(w, img, nil)
+	case "png":
+		if out.restore == "png" {
+			return encodePNGWithRestore(w, img, out)
+		}
+		return png.Encode(w, img)
+	}
+	return errors.New("unsupported format: " + out.format)
+}
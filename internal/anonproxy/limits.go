@@ -0,0 +1,139 @@
+package anonproxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errBusy is returned when too many images are already being checked
+// by Facebox.
+var errBusy = statusError{http.StatusServiceUnavailable, errors.New("too busy, try again shortly")}
+
+// acquire takes a slot to check an image with Facebox, or returns
+// errBusy if they're all taken. Call release when done.
+func (s *server) acquire() (release func(), err error) {
+	if s.checks == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.checks <- struct{}{}:
+		return func() { <-s.checks }, nil
+	default:
+		return nil, errBusy
+	}
+}
+
+// writeError responds with the error, and the status code for it.
+func writeError(w http.ResponseWriter, err error) {
+	code := errorStatus(err)
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// rateLimiter limits how often each client may make requests, with
+// a token bucket per client.
+type rateLimiter struct {
+	// rate is the number of requests a second allowed.
+	rate float64
+	// burst is the number of requests that may be made at once.
+	burst float64
+
+	mu        sync.Mutex
+	clients   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token for the client, or gets how long until there
+// will be one.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets clients whose buckets have filled up again, at most
+// once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.clients {
+		if now.Sub(b.last) > full {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// limit rate limits requests to h by client.
+func (s *server) limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := s.limiter.allow(s.clientIP(r), time.Now())
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientIP gets the address of the client. Behind a reverse proxy,
+// it is the address the proxy added to X-Forwarded-For.
+func (s *server) clientIP(r *http.Request) string {
+	if s.trustForwarded {
+		if forwarded := r.Header["X-Forwarded-For"]; len(forwarded) > 0 {
+			addrs := strings.Split(strings.Join(forwarded, ","), ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
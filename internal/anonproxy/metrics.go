@@ -0,0 +1,179 @@
+package anonproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/machinebox/sdk-go/boxutil"
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "anonproxy",
+		Name:      "requests_total",
+		Help:      "Requests by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "anonproxy",
+		Name:      "request_duration_seconds",
+		Help:      "Time to respond to requests, by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"endpoint"})
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "anonproxy",
+		Name:      "stage_duration_seconds",
+		Help:      "Time spent in each stage (download, decode, facebox, detect, redact and encode).",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2.5, 12),
+	}, []string{"stage"})
+	facesPerImage = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "anonproxy",
+		Name:      "faces_per_image",
+		Help:      "Faces found in each image checked by Facebox.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 8, 13, 21, 34},
+	})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "anonproxy",
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by result (hit, miss or revalidated).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, stageDuration, facesPerImage, cacheRequests)
+}
+
+// endpoints are the paths that get their own metrics; everything else
+// is counted as /.
+var endpoints = map[string]bool{
+	"/":            true,
+	"/anonymise":   true,
+	"/deanonymise": true,
+	"/faces":       true,
+	"/healthz":     true,
+	"/readyz":      true,
+}
+
+// quietEndpoints aren't written to the access log, since they're
+// polled by monitoring.
+var quietEndpoints = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// observe records the time spent in a stage since start.
+func observe(stage string, start time.Time) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// check finds the faces in the image with Facebox.
+func (s *server) check(data []byte) ([]facebox.Face, error) {
+	defer observe("facebox", time.Now())
+	faces, err := s.fb.Check(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	facesPerImage.Observe(float64(len(faces)))
+	return faces, nil
+}
+
+// handleHealthz responds OK while the server is running.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz responds OK when Facebox is ready and the server isn't
+// shutting down.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.stopping:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if !boxutil.IsReady(s.fb) {
+		http.Error(w, "facebox not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// accessLogEntry is a line in the access log.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Client     string  `json:"client"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Src        string  `json:"src,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	Duration   float64 `json:"duration_ms"`
+	Cache      string  `json:"cache,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	RetryAfter string  `json:"retry_after,omitempty"`
+}
+
+// accessLog writes the access log, one JSON object per line.
+var accessLog = log.New(os.Stderr, "", 0)
+
+// instrument records metrics for each request, and writes it to the
+// access log.
+func (s *server) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		duration := time.Since(start)
+		endpoint := r.URL.Path
+		if !endpoints[endpoint] {
+			endpoint = "/"
+		}
+		requestsTotal.WithLabelValues(endpoint, strconv.Itoa(rec.status)).Inc()
+		requestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+		if !s.accessLog || quietEndpoints[endpoint] {
+			return
+		}
+		b, err := json.Marshal(accessLogEntry{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			Client:     s.clientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Src:        r.URL.Query().Get("src"),
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			Duration:   float64(duration) / float64(time.Millisecond),
+			Cache:      rec.Header().Get("X-Cache"),
+			UserAgent:  r.UserAgent(),
+			RetryAfter: rec.Header().Get("Retry-After"),
+		})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		accessLog.Println(string(b))
+	})
+}
+
+// statusRecorder remembers the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
@@ -0,0 +1,310 @@
+package anonproxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Redactor obscures part of an image.
+type Redactor interface {
+	// Redact obscures the area r of img in place.
+	Redact(img *image.RGBA, r image.Rectangle)
+}
+
+// styles make a Redactor for each redaction style, keyed by the name
+// used in the style parameter. To add a style, add it here.
+var styles = map[string]func(p params) (Redactor, error){
+	"solid":    newSolidRedactor,
+	"blur":     newBlurRedactor,
+	"pixelate": newPixelateRedactor,
+	"mask":     newMaskRedactor,
+}
+
+// params are the settings for a request, where values in the query
+// override the defaults (from flags).
+type params struct {
+	query    url.Values
+	defaults map[string]string
+	// mask is the image used by the mask style.
+	mask image.Image
+	// consent is the consent registry, or nil if there isn't one.
+	consent *consentRegistry
+	// overrides is set to let the query redact less than the
+	// defaults, with fewer faces, a weaker style, a smaller shape,
+	// less padding or a bigger minsize.
+	overrides bool
+}
+
+func (p params) get(key string) string {
+	if v := p.query.Get(key); v != "" {
+		return v
+	}
+	return p.defaults[key]
+}
+
+func (p params) int(key string) (int, error) {
+	s := p.get(key)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrap(err, key)
+	}
+	return n, nil
+}
+
+func (p params) float(key string) (float64, error) {
+	s := p.get(key)
+	if s == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, key)
+	}
+	return f, nil
+}
+
+// redactor makes the Redactor for the style in p.
+func (p params) redactor() (Redactor, error) {
+	style := p.get("style")
+	newRedactor, ok := styles[style]
+	if !ok {
+		return nil, errors.New("style: unknown style " + strconv.Quote(style))
+	}
+	redactor, err := newRedactor(p)
+	if err != nil {
+		return nil, errors.Wrap(err, style)
+	}
+	return redactor, nil
+}
+
+// solidRedactor fills the area with a colour.
+type solidRedactor struct {
+	color color.Color
+}
+
+func newSolidRedactor(p params) (Redactor, error) {
+	c, err := parseColor(p.get("color"))
+	if err != nil {
+		return nil, errors.Wrap(err, "color")
+	}
+	return solidRedactor{color: c}, nil
+}
+
+func (s solidRedactor) Redact(img *image.RGBA, r image.Rectangle) {
+	draw.Draw(img, r, &image.Uniform{s.color}, image.ZP, draw.Src)
+}
+
+// parseColor parses hex colours like ff0000, #ff0000 or f00.
+// An empty string is black.
+func parseColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if s == "" {
+		return color.Black, nil
+	}
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return nil, errors.New("expected hex colour like ff0000")
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, errors.New("expected hex colour like ff0000")
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// maxBlock and maxRadius are the largest pixelation block and blur
+// radius allowed, so requests can't use up all the memory.
+const (
+	maxBlock  = 1000
+	maxRadius = 500
+)
+
+// minBlockDivisor and minRadiusDivisor set the smallest block and blur
+// radius for an area, as its size divided by them, so a tiny block or
+// radius can't leave the face recognisable.
+const (
+	minBlockDivisor  = 12
+	minRadiusDivisor = 8
+)
+
+// pixelateRedactor replaces blocks of pixels with their average colour.
+type pixelateRedactor struct {
+	// block is the size of the blocks, or zero to size them
+	// to the area.
+	block int
+}
+
+func newPixelateRedactor(p params) (Redactor, error) {
+	block, err := p.int("block")
+	if err != nil {
+		return nil, err
+	}
+	if block < 0 || block > maxBlock {
+		return nil, errors.New("block must be between 0 and " + strconv.Itoa(maxBlock))
+	}
+	return pixelateRedactor{block: block}, nil
+}
+
+func (p pixelateRedactor) Redact(img *image.RGBA, r image.Rectangle) {
+	r = r.Intersect(img.Bounds())
+	size := max(r.Dx(), r.Dy())
+	block := p.block
+	if block == 0 {
+		// about eight blocks across the face
+		block = size / 8
+	}
+	// bigger blocks than the face look the same
+	block = clamp(block, max(1, size/minBlockDivisor), size)
+	for y := r.Min.Y; y < r.Max.Y; y += block {
+		for x := r.Min.X; x < r.Max.X; x += block {
+			b := image.Rect(x, y, x+block, y+block).Intersect(r)
+			var sr, sg, sb, sa, n int
+			for by := b.Min.Y; by < b.Max.Y; by++ {
+				for bx := b.Min.X; bx < b.Max.X; bx++ {
+					i := img.PixOffset(bx, by)
+					sr += int(img.Pix[i])
+					sg += int(img.Pix[i+1])
+					sb += int(img.Pix[i+2])
+					sa += int(img.Pix[i+3])
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			avg := color.RGBA{uint8(sr / n), uint8(sg / n), uint8(sb / n), uint8(sa / n)}
+			draw.Draw(img, b, &image.Uniform{avg}, image.ZP, draw.Src)
+		}
+	}
+}
+
+// blurRedactor applies a Gaussian blur.
+type blurRedactor struct {
+	// radius is the blur radius in pixels, or zero to size it
+	// to the area.
+	radius int
+}
+
+func newBlurRedactor(p params) (Redactor, error) {
+	radius, err := p.int("radius")
+	if err != nil {
+		return nil, err
+	}
+	if radius < 0 || radius > maxRadius {
+		return nil, errors.New("radius must be between 0 and " + strconv.Itoa(maxRadius))
+	}
+	return blurRedactor{radius: radius}, nil
+}
+
+func (b blurRedactor) Redact(img *image.RGBA, r image.Rectangle) {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return
+	}
+	size := max(r.Dx(), r.Dy())
+	radius := b.radius
+	if radius == 0 {
+		radius = size / 4
+	}
+	// a bigger radius than the face blurs it to much the same colour
+	radius = clamp(radius, max(1, size/minRadiusDivisor), size)
+	// kernel covers three standard deviations either side
+	sigma := float64(radius) / 3
+	kernel := make([]float64, 2*radius+1)
+	var total float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		total += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= total
+	}
+	w, h := r.Dx(), r.Dy()
+	buf := make([]float64, w*h*4)
+	tmp := make([]float64, w*h*4)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(r.Min.X+x, r.Min.Y+y)
+			for c := 0; c < 4; c++ {
+				buf[(y*w+x)*4+c] = float64(img.Pix[i+c])
+			}
+		}
+	}
+	// separable blur; horizontal then vertical, clamping at the edges
+	// of the area so nothing outside it bleeds in
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for k, weight := range kernel {
+				sx := clamp(x+k-radius, 0, w-1)
+				for c := 0; c < 4; c++ {
+					sum[c] += buf[(y*w+sx)*4+c] * weight
+				}
+			}
+			copy(tmp[(y*w+x)*4:], sum[:])
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for k, weight := range kernel {
+				sy := clamp(y+k-radius, 0, h-1)
+				for c := 0; c < 4; c++ {
+					sum[c] += tmp[(sy*w+x)*4+c] * weight
+				}
+			}
+			i := img.PixOffset(r.Min.X+x, r.Min.Y+y)
+			for c := 0; c < 4; c++ {
+				img.Pix[i+c] = uint8(clamp(int(sum[c]+0.5), 0, 255))
+			}
+		}
+	}
+}
+
+// maskRedactor draws an image (like an emoji) over the area, scaled
+// to fit.
+type maskRedactor struct {
+	mask image.Image
+}
+
+func newMaskRedactor(p params) (Redactor, error) {
+	if p.mask == nil {
+		return nil, errors.New("no mask image (use -mask)")
+	}
+	return maskRedactor{mask: p.mask}, nil
+}
+
+func (m maskRedactor) Redact(img *image.RGBA, r image.Rectangle) {
+	xdraw.ApproxBiLinear.Scale(img, r, m.mask, m.mask.Bounds(), draw.Over, nil)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
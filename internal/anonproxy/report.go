@@ -0,0 +1,172 @@
+package anonproxy
+
+import (
+	"image"
+
+	"github.com/machinebox/sdk-go/facebox"
+)
+
+// report describes the faces (and any other objects) found in an image,
+// and what was done to them.
+type report struct {
+	Width     int          `json:"width"`
+	Height    int          `json:"height"`
+	Redaction redaction    `json:"redaction"`
+	Faces     []faceReport `json:"faces"`
+	// Objects are the things found by detectors other than Facebox.
+	Objects []objectReport `json:"objects,omitempty"`
+	// Redacted is the number of faces and objects that were redacted.
+	Redacted int `json:"redacted"`
+	// Frames is the number of frames in an animated GIF.
+	Frames int `json:"frames,omitempty"`
+}
+
+// redaction describes the redaction applied to faces.
+type redaction struct {
+	Style     string  `json:"style"`
+	Shape     string  `json:"shape"`
+	Padding   float64 `json:"padding"`
+	Feather   int     `json:"feather"`
+	Selection string  `json:"selection"`
+	// Labels are the labels of objects that are redacted.
+	Labels []string `json:"labels,omitempty"`
+}
+
+// faceReport describes a face.
+// Names and IDs are only given for faces that are left alone, so the
+// report can't be used to identify people whose faces were redacted.
+type faceReport struct {
+	// Frame is the frame of an animated GIF the face is in.
+	Frame      int     `json:"frame"`
+	Rect       rect    `json:"rect"`
+	Matched    bool    `json:"matched"`
+	Name       string  `json:"name,omitempty"`
+	ID         string  `json:"id,omitempty"`
+	Confidence float64 `json:"confidence"`
+	Redacted   bool    `json:"redacted"`
+	// Area is the area that was redacted, including padding.
+	Area *rect `json:"area,omitempty"`
+	// Reason is why the face was left alone.
+	Reason string `json:"reason,omitempty"`
+
+	area image.Rectangle
+}
+
+// objectReport describes an object found by a Detector.
+type objectReport struct {
+	// Frame is the frame of an animated GIF the object is in.
+	Frame      int     `json:"frame"`
+	Label      string  `json:"label"`
+	Rect       rect    `json:"rect"`
+	Confidence float64 `json:"confidence"`
+	Redacted   bool    `json:"redacted"`
+	// Area is the area that was redacted, including padding.
+	Area *rect `json:"area,omitempty"`
+	// Reason is why the object was left alone.
+	Reason string `json:"reason,omitempty"`
+
+	area image.Rectangle
+}
+
+// rect is a rectangle in the same form as Facebox uses.
+type rect struct {
+	Top    int `json:"top"`
+	Left   int `json:"left"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func newRect(r image.Rectangle) rect {
+	return rect{Top: r.Min.Y, Left: r.Min.X, Width: r.Dx(), Height: r.Dy()}
+}
+
+// faceRect gets the rectangle of a face.
+func faceRect(face facebox.Face) image.Rectangle {
+	return image.Rect(
+		face.Rect.Left,
+		face.Rect.Top,
+		face.Rect.Left+face.Rect.Width,
+		face.Rect.Top+face.Rect.Height,
+	)
+}
+
+// report decides what to do with each face and object found in an image
+// with the bounds.
+func (o options) report(found detections, bounds image.Rectangle) report {
+	rep := report{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Redaction: redaction{
+			Style:     o.style,
+			Shape:     o.shape,
+			Padding:   o.padding,
+			Feather:   o.feather,
+			Selection: o.selection,
+			Labels:    o.labelList(),
+		},
+		Faces: make([]faceReport, 0, len(found.faces)),
+	}
+	for _, face := range found.faces {
+		fr := faceReport{
+			Rect:       newRect(faceRect(face)),
+			Matched:    face.Matched,
+			Confidence: face.Confidence,
+		}
+		area, ok := o.area(faceRect(face), bounds)
+		switch {
+		case !o.selected(face):
+			fr.Reason = "selection"
+		case !ok:
+			fr.Reason = "size"
+		default:
+			fr.Redacted = true
+			fr.area = area
+			areaRect := newRect(area)
+			fr.Area = &areaRect
+			rep.Redacted++
+		}
+		if !fr.Redacted {
+			fr.Name = face.Name
+			fr.ID = face.ID
+		}
+		rep.Faces = append(rep.Faces, fr)
+	}
+	for _, object := range found.objects {
+		or := objectReport{
+			Label:      object.Label,
+			Rect:       newRect(object.Rect),
+			Confidence: object.Confidence,
+		}
+		area, ok := o.area(object.Rect, bounds)
+		switch {
+		case !o.labelled(object.Label):
+			or.Reason = "label"
+		case !ok:
+			or.Reason = "size"
+		default:
+			or.Redacted = true
+			or.area = area
+			areaRect := newRect(area)
+			or.Area = &areaRect
+			rep.Redacted++
+		}
+		rep.Objects = append(rep.Objects, or)
+	}
+	return rep
+}
+
+// areas gets the areas to redact.
+func (rep report) areas() []image.Rectangle {
+	var areas []image.Rectangle
+	for _, face := range rep.Faces {
+		if face.Redacted {
+			areas = append(areas, face.area)
+		}
+	}
+	for _, object := range rep.Objects {
+		if object.Redacted {
+			areas = append(areas, object.area)
+		}
+	}
+	return areas
+}
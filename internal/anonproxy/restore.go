@@ -0,0 +1,392 @@
+package anonproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+)
+
+// restoreModes are the ways the original faces can be kept, so the
+// image can be deanonymised by whoever has the key.
+var restoreModes = map[string]bool{
+	// png keeps them in a chunk of the PNG image.
+	"png": true,
+	// sidecar keeps them separately from the image.
+	"sidecar": true,
+}
+
+// restoreChunk is the type of the PNG chunk the original faces are kept
+// in. It is ancillary, private, and unsafe to copy, so editors drop it
+// if they change the image.
+const restoreChunk = "faCE"
+
+// restoreVersion is the first byte of sealed restore data. Version 2
+// data is tied to the image it was sealed for.
+const restoreVersion = 2
+
+// restoreData is the original pixels of the redacted areas of an image.
+type restoreData struct {
+	Width   int             `json:"width"`
+	Height  int             `json:"height"`
+	Regions []restoreRegion `json:"regions"`
+}
+
+// restoreRegion is an area of the original image.
+type restoreRegion struct {
+	Rect rect `json:"rect"`
+	// PNG is the original pixels.
+	PNG []byte `json:"png"`
+}
+
+// parseRestoreKey parses a hex encoded AES key (16, 24 or 32 bytes).
+func parseRestoreKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "restore key")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, errors.New("restore key must be 16, 24 or 32 bytes, hex encoded")
+}
+
+// keepOriginal gets the original pixels of the areas in rep that were
+// redacted (and feathered), to seal once the image is encoded.
+func keepOriginal(src image.Image, rep report, feather int) ([]byte, error) {
+	bounds := src.Bounds()
+	data := restoreData{Width: bounds.Dx(), Height: bounds.Dy()}
+	for _, area := range rep.areas() {
+		r := area.Inset(-feather).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+		region := image.NewRGBA(r)
+		draw.Draw(region, r, src, r.Min, draw.Src)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, region); err != nil {
+			return nil, err
+		}
+		data.Regions = append(data.Regions, restoreRegion{Rect: newRect(r.Sub(bounds.Min)), PNG: buf.Bytes()})
+	}
+	return json.Marshal(data)
+}
+
+// restoreAdditionalData ties sealed restore data to the encoded
+// anonymised image, so it can't be used to put faces on another one.
+func restoreAdditionalData(encoded []byte) []byte {
+	sum := sha256.Sum256(encoded)
+	return append([]byte{restoreVersion}, sum[:]...)
+}
+
+// sealRestore encrypts the original pixels (from keepOriginal) with the
+// key, for the encoded anonymised image.
+func sealRestore(key, original, encoded []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 1+gcm.NonceSize(), 1+gcm.NonceSize()+len(original)+gcm.Overhead())
+	sealed[0] = restoreVersion
+	if _, err := io.ReadFull(rand.Reader, sealed[1:]); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(sealed, sealed[1:], original, restoreAdditionalData(encoded)), nil
+}
+
+// openRestore decrypts sealed restore data with the key. encoded is the
+// anonymised image it was sealed for, without the restore chunk.
+func openRestore(key, sealed, encoded []byte) (*restoreData, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+gcm.NonceSize() || sealed[0] != restoreVersion {
+		return nil, errors.New("restore: not restore data")
+	}
+	nonce := sealed[1 : 1+gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, sealed[1+gcm.NonceSize():], restoreAdditionalData(encoded))
+	if err != nil {
+		return nil, errors.New("restore: wrong key, the data has been changed, or it's for another image")
+	}
+	var data restoreData
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return nil, errors.Wrap(err, "restore")
+	}
+	return &data, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "restore key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// deanonymise puts the original pixels back into the anonymised image.
+func deanonymise(img image.Image, data *restoreData) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() != data.Width || bounds.Dy() != data.Height {
+		return nil, errors.New("restore: the image is a different size to the one anonymised")
+	}
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	for _, region := range data.Regions {
+		original, err := png.Decode(bytes.NewReader(region.PNG))
+		if err != nil {
+			return nil, errors.Wrap(err, "restore")
+		}
+		r := image.Rect(region.Rect.Left, region.Rect.Top, region.Rect.Left+region.Rect.Width, region.Rect.Top+region.Rect.Height)
+		draw.Draw(dst, r.Add(bounds.Min), original, original.Bounds().Min, draw.Src)
+	}
+	return dst, nil
+}
+
+// addPNGChunk adds a chunk to a PNG image, just before the end.
+func addPNGChunk(b []byte, chunkType string, data []byte) ([]byte, error) {
+	const iendSize = 12
+	if len(b) < 8+iendSize || string(b[len(b)-iendSize+4:len(b)-iendSize+8]) != "IEND" {
+		return nil, errors.New("png: no IEND chunk")
+	}
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+	out := make([]byte, 0, len(b)+len(chunk))
+	out = append(out, b[:len(b)-iendSize]...)
+	out = append(out, chunk...)
+	return append(out, b[len(b)-iendSize:]...), nil
+}
+
+// pngChunk gets the data of the first chunk of the type in a PNG image,
+// or nil if there isn't one.
+func pngChunk(b []byte, chunkType string) []byte {
+	start, end := findPNGChunk(b, chunkType)
+	if start == -1 {
+		return nil
+	}
+	return b[start+8 : end-4]
+}
+
+// withoutPNGChunk gets the PNG image without the first chunk of the
+// type.
+func withoutPNGChunk(b []byte, chunkType string) []byte {
+	start, end := findPNGChunk(b, chunkType)
+	if start == -1 {
+		return b
+	}
+	out := make([]byte, 0, len(b)-(end-start))
+	out = append(out, b[:start]...)
+	return append(out, b[end:]...)
+}
+
+// findPNGChunk gets where the first chunk of the type starts and ends
+// in a PNG image, or -1 if there isn't one.
+func findPNGChunk(b []byte, chunkType string) (int, int) {
+	if len(b) < 8 || string(b[1:4]) != "PNG" {
+		return -1, -1
+	}
+	for i := 8; i+12 <= len(b); {
+		length := int(binary.BigEndian.Uint32(b[i:]))
+		if length < 0 || i+12+length > len(b) {
+			return -1, -1
+		}
+		if string(b[i+4:i+8]) == chunkType {
+			return i, i + 12 + length
+		}
+		i += 12 + length
+	}
+	return -1, -1
+}
+
+// encodePNGWithRestore writes img to w as a PNG image, with the original
+// faces sealed in a chunk.
+func encodePNGWithRestore(w io.Writer, img image.Image, out output) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	sealed, err := out.seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	b, err := addPNGChunk(buf.Bytes(), restoreChunk, sealed)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// restoreFlags adds the flags for reversible anonymisation to flags.
+// Once the flags are parsed, call the function it returns to add the
+// default to the defaults, and get the key.
+func restoreFlags(flags *flag.FlagSet) func(defaults map[string]string) ([]byte, error) {
+	var (
+		restore    = flags.String("restore", "", "default for keeping the original faces, encrypted, so images can be deanonymised (png keeps them in the image, sidecar separately; empty doesn't keep them)")
+		restoreKey = flags.String("restorekey", "", "hex encoded AES key (16, 24 or 32 bytes) to encrypt the original faces with, like from openssl rand -hex 32")
+	)
+	return func(defaults map[string]string) ([]byte, error) {
+		defaults["restore"] = *restore
+		if *restoreKey == "" {
+			if *restore != "" {
+				return nil, errors.New("restore needs restorekey")
+			}
+			return nil, nil
+		}
+		return parseRestoreKey(*restoreKey)
+	}
+}
+
+// handleDeanonymise restores the original faces to an image that was
+// anonymised with restore. The key is given in the X-Restore-Key header.
+// The image is uploaded like for /anonymise; the sidecar goes in a
+// multipart file or JSON field called restore, unless it's in the PNG
+// image. The restored image is a PNG.
+func (s *server) handleDeanonymise(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST an anonymised image to deanonymise", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := parseRestoreKey(r.Header.Get("X-Restore-Key"))
+	if err != nil {
+		http.Error(w, "X-Restore-Key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := s.readUpload(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	img, err := restoreImage(u.image, u.restore, key)
+	if err != nil {
+		writeError(w, statusError{http.StatusBadRequest, err})
+		return
+	}
+	w.Header().Set("Content-Type", formats["png"])
+	if err := png.Encode(w, img); err != nil {
+		log.Println(err)
+	}
+}
+
+// restoreImage decodes the anonymised image, and restores the original
+// faces from the sealed data, or the PNG chunk if sealed is nil.
+func restoreImage(b, sealed, key []byte) (image.Image, error) {
+	encoded := b
+	if sealed == nil {
+		sealed = pngChunk(b, restoreChunk)
+		if sealed == nil {
+			return nil, errors.New("restore: the image has no original faces (was it anonymised with restore=png?)")
+		}
+		encoded = withoutPNGChunk(b, restoreChunk)
+	}
+	data, err := openRestore(key, sealed, encoded)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return deanonymise(img, data)
+}
+
+// deanonymiseSummary describes the deanonymise command in help output.
+const deanonymiseSummary = "Restore the faces to images anonymised with restore"
+
+// DeanonymiseCommand is the deanonymise command.
+var DeanonymiseCommand = cli.Command{
+	Name:    "deanonymise",
+	Summary: deanonymiseSummary,
+	Run:     RunDeanonymise,
+}
+
+// RunDeanonymise restores the original faces to each image given as an
+// argument, and writes them as PNG images.
+func RunDeanonymise(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("deanonymise", deanonymiseSummary+".")
+	var (
+		keyHex  = flags.String("restorekey", "", "hex encoded key the images were anonymised with (anonproxy -restorekey)")
+		sidecar = flags.String("restore", "", "sidecar file with the original faces (default is <image>.restore if it exists, otherwise the PNG image)")
+		out     = flags.String("out", "", "file to write the restored image to (default is <image>-restored.png)")
+	)
+	if ok, err := config.Parse("deanonymise", flags, args); !ok {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("image files required")
+	}
+	if flags.NArg() > 1 && (*sidecar != "" || *out != "") {
+		return errors.New("restore and out can only be used with one image")
+	}
+	key, err := parseRestoreKey(*keyHex)
+	if err != nil {
+		return err
+	}
+	for _, path := range flags.Args() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sidecarPath := *sidecar
+		if sidecarPath == "" {
+			if _, err := os.Stat(path + ".restore"); err == nil {
+				sidecarPath = path + ".restore"
+			}
+		}
+		var sealed []byte
+		if sidecarPath != "" {
+			if sealed, err = ioutil.ReadFile(sidecarPath); err != nil {
+				return err
+			}
+		}
+		img, err := restoreImage(b, sealed, key)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+		outPath := *out
+		if outPath == "" {
+			outPath = strings.TrimSuffix(path, filepath.Ext(path)) + "-restored.png"
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		if err := writeFile(outPath, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+		fmt.Println(outPath)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package anonproxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/pkg/errors"
+)
+
+// selections decide which faces are redacted, keyed by the name used in
+// the redact parameter.
+var selections = map[string]func(face facebox.Face, o options) bool{
+	// all redacts every face.
+	"all": func(face facebox.Face, o options) bool {
+		return true
+	},
+	// unmatched redacts faces Facebox doesn't recognise.
+	"unmatched": func(face facebox.Face, o options) bool {
+		return !face.Matched
+	},
+	// matched redacts faces Facebox recognises.
+	"matched": func(face facebox.Face, o options) bool {
+		return face.Matched
+	},
+	// except redacts every face except recognised ones in the allow list.
+	"except": func(face facebox.Face, o options) bool {
+		return !face.Matched || !(o.allow[face.Name] || o.allow[face.ID])
+	},
+	// consented redacts every face except recognised people who have
+	// given consent in the registry.
+	"consented": func(face facebox.Face, o options) bool {
+		return !face.Matched || o.consent.status(face.ID) != consentGiven
+	},
+}
+
+// selection gets the selection and allow list for the request.
+// Unless overrides are allowed, the query may only choose a selection
+// that redacts every face the defaults would.
+func (p params) selection() (string, map[string]bool, error) {
+	selection, allow, err := parseSelection(p.get("redact"), p.get("allow"))
+	if err != nil {
+		return "", nil, err
+	}
+	if p.overrides || (p.query.Get("redact") == "" && p.query.Get("allow") == "") {
+		return selection, allow, nil
+	}
+	defaultSelection, defaultAllow, err := parseSelection(p.defaults["redact"], p.defaults["allow"])
+	if err != nil {
+		return "", nil, err
+	}
+	if !stricter(selection, allow, defaultSelection, defaultAllow) {
+		return "", nil, errors.New("redact: can only redact more faces than " + strconv.Quote(defaultSelection) + " (see -overrides)")
+	}
+	return selection, allow, nil
+}
+
+// parseSelection parses the redact and allow parameters.
+func parseSelection(selection, allowList string) (string, map[string]bool, error) {
+	if selection == "" {
+		selection = "all"
+	}
+	if _, ok := selections[selection]; !ok {
+		return "", nil, errors.New("redact: unknown selection " + strconv.Quote(selection))
+	}
+	allow := make(map[string]bool)
+	for _, item := range strings.Split(allowList, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		allow[item] = true
+	}
+	if selection == "except" && len(allow) == 0 {
+		return "", nil, errors.New("redact: except needs names or IDs to allow")
+	}
+	return selection, allow, nil
+}
+
+// stricter gets whether the selection redacts every face that the other
+// selection does.
+func stricter(selection string, allow map[string]bool, other string, otherAllow map[string]bool) bool {
+	switch {
+	case selection == "all":
+		return true
+	case selection == other && selection == "except":
+		for item := range allow {
+			if !otherAllow[item] {
+				return false
+			}
+		}
+		return true
+	case selection == other:
+		return true
+	case other == "unmatched":
+		// except and consented redact strangers too
+		return selection == "except" || selection == "consented"
+	}
+	return false
+}
+
+// selected gets whether the face should be redacted. People who have
+// refused consent are always redacted, whatever the selection.
+func (o options) selected(face facebox.Face) bool {
+	if face.Matched && o.consent.status(face.ID) == consentRefused {
+		return true
+	}
+	return selections[o.selection](face, o)
+}
+
+// labels gets the labels of objects to redact for the request.
+// Unless overrides are allowed, the query may only add labels to the
+// defaults.
+func (p params) labels() (map[string]bool, error) {
+	labels := make(map[string]bool)
+	for _, label := range splitList(p.get("labels")) {
+		labels[label] = true
+	}
+	if p.overrides || p.query.Get("labels") == "" || labels["*"] {
+		return labels, nil
+	}
+	for _, label := range splitList(p.defaults["labels"]) {
+		if !labels[label] {
+			return nil, errors.New("labels: can only add to " + strconv.Quote(p.defaults["labels"]) + " (see -overrides)")
+		}
+	}
+	return labels, nil
+}
+
+// labelList gets the labels of objects to redact, in order.
+func (o options) labelList() []string {
+	var labels []string
+	for label := range o.labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// labelled gets whether objects with the label should be redacted.
+func (o options) labelled(label string) bool {
+	return o.labels["*"] || o.labels[strings.ToLower(label)]
+}
@@ -0,0 +1,604 @@
+package anonproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// server is the anonproxy HTTP server.
+type server struct {
+	fb      *facebox.Client
+	fetcher *fetcher
+	// defaults are the default parameters (from flags).
+	defaults map[string]string
+	// mask is the image used by the mask style.
+	mask image.Image
+	// maxSize is the largest image in bytes that may be uploaded.
+	maxSize int64
+	// cache holds redacted images, or is nil to not cache them.
+	cache *cache
+	// cacheTTL is how long to cache images whose source doesn't say.
+	cacheTTL time.Duration
+	// checks limits how many images are checked by Facebox at once, or
+	// is nil for no limit.
+	checks chan struct{}
+	// limiter limits how often each client may make requests, or is
+	// nil for no limit.
+	limiter *rateLimiter
+	// trustForwarded is set when the server is behind a reverse proxy
+	// that sets X-Forwarded-For.
+	trustForwarded bool
+	// accessLog is set to write a line to the access log for each
+	// request.
+	accessLog bool
+	// detectors find objects to redact as well as faces.
+	detectors []Detector
+	// secret is the key that request URLs must be signed with, or nil
+	// to allow unsigned requests.
+	secret []byte
+	// restoreKey is the key the original faces are encrypted with, for
+	// the restore parameter, or nil if they can't be kept.
+	restoreKey []byte
+	// consent is the consent registry, or nil if there isn't one.
+	consent *consentRegistry
+	// overrides is set to let the query redact less than the
+	// defaults.
+	overrides bool
+	// settings identifies the settings that aren't parameters, for
+	// the cache key (see settingsKey).
+	settings     string
+	settingsOnce sync.Once
+	// stopping is closed when the server starts shutting down.
+	stopping chan struct{}
+	mux      *http.ServeMux
+	handler  http.Handler
+}
+
+func newServer(fb *facebox.Client, fetcher *fetcher, defaults map[string]string, mask image.Image) *server {
+	s := &server{
+		fb:       fb,
+		fetcher:  fetcher,
+		defaults: defaults,
+		mask:     mask,
+		maxSize:  fetcher.maxSize,
+		stopping: make(chan struct{}),
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/anonymise", s.handleAnonymise)
+	s.mux.HandleFunc("/deanonymise", s.handleDeanonymise)
+	s.mux.HandleFunc("/faces", s.handleFaces)
+	s.mux.HandleFunc("/", s.handleProxy)
+	// health checks aren't rate limited
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", s.handleHealthz)
+	root.HandleFunc("/readyz", s.handleReadyz)
+	root.Handle("/", s.limit(s.requireSigned(s.mux)))
+	s.handler = s.instrument(root)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// admin gets the handler for the admin listener, which isn't exposed to
+// the internet: the Prometheus metrics, and the consent registry API if
+// there is one.
+func (s *server) admin() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if s.consent != nil {
+		api := consentAPI(s.consent)
+		mux.Handle("/consent", api)
+		mux.Handle("/consent/", api)
+	}
+	return mux
+}
+
+// handleProxy anonymises the image at the src URL.
+func (s *server) handleProxy(w http.ResponseWriter, r *http.Request) {
+	urlStr := r.URL.Query().Get("src")
+	p := s.params(r)
+	opts, err := p.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.get("restore") == "sidecar" {
+		http.Error(w, "restore: sidecar is only for JSON uploads to /anonymise", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	var key string
+	var cached *cacheEntry
+	if s.cache != nil {
+		key = cacheKey(urlStr, p, s.settingsKey())
+		cached, _ = s.cache.get(key)
+	}
+	if cached != nil && cached.fresh(now) {
+		s.writeEntry(w, r, cached, "HIT")
+		return
+	}
+	var srcETag, srcLastModified string
+	if cached != nil {
+		srcETag, srcLastModified = cached.SrcETag, cached.SrcLastModified
+	}
+	downloadStart := time.Now()
+	d, err := s.fetcher.get(r.Context(), urlStr, srcETag, srcLastModified)
+	observe("download", downloadStart)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ttl, store := freshness(d.header, now, s.cacheTTL)
+	if d.notModified {
+		// the source hasn't changed, so neither has the redacted image
+		entry := *cached
+		entry.Expires = now.Add(ttl)
+		if store {
+			s.cache.put(key, &entry)
+		}
+		s.writeEntry(w, r, &entry, "REVALIDATED")
+		return
+	}
+	img, out, rep, err := s.anonymise(d.body, p, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, header, err := encodeImage(p, img, out, rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entry := &cacheEntry{
+		Body:            b,
+		Header:          header,
+		ETag:            makeETag(b),
+		Expires:         now.Add(ttl),
+		SrcETag:         d.header.Get("ETag"),
+		SrcLastModified: d.header.Get("Last-Modified"),
+		noStore:         !store,
+	}
+	if s.cache != nil && store {
+		s.cache.put(key, entry)
+	}
+	s.writeEntry(w, r, entry, "MISS")
+}
+
+// writeEntry writes the redacted image in the response, with caching
+// headers, or responds 304 Not Modified if the client already has it.
+// The cache status is given in the X-Cache header.
+func (s *server) writeEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, cacheStatus string) {
+	for key, values := range entry.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("ETag", entry.ETag)
+	if entry.noStore {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		maxAge := int(time.Until(entry.Expires) / time.Second)
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	}
+	if s.cache != nil {
+		w.Header().Set("X-Cache", cacheStatus)
+		cacheRequests.WithLabelValues(strings.ToLower(cacheStatus)).Inc()
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), entry.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	if _, err := w.Write(entry.Body); err != nil {
+		log.Println(err)
+	}
+}
+
+// writeImage writes the redacted image in the response.
+func (s *server) writeImage(w http.ResponseWriter, p params, img image.Image, out output, rep report) {
+	b, header, err := encodeImage(p, img, out, rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	if _, err := w.Write(b); err != nil {
+		log.Println(err)
+	}
+}
+
+// encodeImage encodes the redacted image, and gets the headers to send
+// with it.
+func encodeImage(p params, img image.Image, out output, rep report) ([]byte, http.Header, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", formats[out.format])
+	if p.get("report") == "header" {
+		b, err := json.Marshal(rep)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("X-Faces-Redacted", string(b))
+	}
+	encodeStart := time.Now()
+	var buf bytes.Buffer
+	if err := encode(&buf, img, out); err != nil {
+		return nil, nil, err
+	}
+	observe("encode", encodeStart)
+	return buf.Bytes(), header, nil
+}
+
+// handleAnonymise anonymises an uploaded image. The image is the body of
+// the request, a multipart file called image, or base64 in a JSON object
+// like {"image":"..."}. JSON requests get a JSON response in the same form.
+func (s *server) handleAnonymise(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST an image to anonymise", http.StatusMethodNotAllowed)
+		return
+	}
+	p := s.params(r)
+	opts, err := p.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := s.readUpload(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if u.mediaType != "application/json" && p.get("restore") == "sidecar" {
+		http.Error(w, "restore: sidecar is only for JSON uploads", http.StatusBadRequest)
+		return
+	}
+	img, out, rep, err := s.anonymise(u.image, p, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if u.mediaType != "application/json" {
+		s.writeImage(w, p, img, out, rep)
+		return
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, img, out); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := imageJSON{
+		Image:  base64.StdEncoding.EncodeToString(buf.Bytes()),
+		Format: out.format,
+		Report: &rep,
+	}
+	if out.restore == "sidecar" {
+		sealed, err := out.seal(buf.Bytes())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Restore = base64.StdEncoding.EncodeToString(sealed)
+	}
+	writeJSON(w, res)
+}
+
+// handleFaces describes the faces (and objects) in the image at the src URL (or
+// uploaded like for /anonymise), and what would be done to them,
+// without redacting anything.
+func (s *server) handleFaces(w http.ResponseWriter, r *http.Request) {
+	p := s.params(r)
+	opts, err := p.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var b []byte
+	switch r.Method {
+	case http.MethodGet:
+		downloadStart := time.Now()
+		b, err = s.fetcher.fetch(r.Context(), r.URL.Query().Get("src"))
+		observe("download", downloadStart)
+	case http.MethodPost:
+		var u *upload
+		if u, err = s.readUpload(w, r); err == nil {
+			b = u.image
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "GET with src or POST an image", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	release, err := s.acquire()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+	src, err := decodeSource(b)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	found, err := s.detectAll(src.data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, opts.report(found, src.img.Bounds()))
+}
+
+// upload is an uploaded image.
+type upload struct {
+	image []byte
+	// restore is the sealed original faces uploaded with an image to
+	// deanonymise, or nil.
+	restore []byte
+	// mediaType is the media type of the request.
+	mediaType string
+}
+
+// readUpload reads the uploaded image.
+func (s *server) readUpload(w http.ResponseWriter, r *http.Request) (*upload, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	u := &upload{mediaType: mediaType}
+	var err error
+	switch mediaType {
+	case "multipart/form-data":
+		err = s.readMultipart(w, r, u)
+	case "application/json":
+		err = s.readJSON(w, r, u)
+	default:
+		u.image, err = s.readBody(w, r.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// imageJSON is an image in a JSON request or response.
+type imageJSON struct {
+	// Image is the base64 encoded image. Data URIs are accepted in
+	// requests.
+	Image string `json:"image"`
+	// Format is the format of the image.
+	Format string `json:"format,omitempty"`
+	// Report describes the faces, in responses.
+	Report *report `json:"report,omitempty"`
+	// Restore is the base64 encoded sidecar with the original faces,
+	// in responses with restore=sidecar and requests to /deanonymise.
+	Restore string `json:"restore,omitempty"`
+}
+
+func (s *server) readBody(w http.ResponseWriter, body io.ReadCloser) ([]byte, error) {
+	if s.maxSize > 0 {
+		body = http.MaxBytesReader(w, body, s.maxSize)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, statusError{http.StatusRequestEntityTooLarge, errors.Wrap(err, "image")}
+	}
+	if len(b) == 0 {
+		return nil, statusError{http.StatusBadRequest, errors.New("image: missing")}
+	}
+	return b, nil
+}
+
+func (s *server) readMultipart(w http.ResponseWriter, r *http.Request, u *upload) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return statusError{http.StatusBadRequest, errors.Wrap(err, "multipart")}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return statusError{http.StatusBadRequest, errors.Wrap(err, "multipart")}
+		}
+		switch part.FormName() {
+		case "image":
+			if u.image, err = s.readBody(w, part); err != nil {
+				return err
+			}
+		case "restore":
+			if u.restore, err = s.readBody(w, part); err != nil {
+				return errors.Wrap(err, "restore")
+			}
+		}
+	}
+	if u.image == nil {
+		return statusError{http.StatusBadRequest, errors.New("image: missing (upload a file called image)")}
+	}
+	return nil
+}
+
+func (s *server) readJSON(w http.ResponseWriter, r *http.Request, u *upload) error {
+	body := r.Body
+	if s.maxSize > 0 {
+		// base64 is a third bigger than the image
+		body = http.MaxBytesReader(w, body, s.maxSize/3*4+1024)
+	}
+	var req imageJSON
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return statusError{http.StatusBadRequest, errors.Wrap(err, "json")}
+	}
+	data := req.Image
+	if strings.HasPrefix(data, "data:") {
+		i := strings.Index(data, ",")
+		if i == -1 {
+			return statusError{http.StatusBadRequest, errors.New("image: bad data URI")}
+		}
+		data = data[i+1:]
+	}
+	var err error
+	if u.image, err = base64.StdEncoding.DecodeString(data); err != nil {
+		return statusError{http.StatusBadRequest, errors.Wrap(err, "image")}
+	}
+	if len(u.image) == 0 {
+		return statusError{http.StatusBadRequest, errors.New("image: missing")}
+	}
+	if req.Restore != "" {
+		if u.restore, err = base64.StdEncoding.DecodeString(req.Restore); err != nil {
+			return statusError{http.StatusBadRequest, errors.Wrap(err, "restore")}
+		}
+	}
+	return nil
+}
+
+// params gets the parameters for the request.
+func (s *server) params(r *http.Request) params {
+	return params{
+		query:     r.URL.Query(),
+		defaults:  s.defaults,
+		mask:      s.mask,
+		consent:   s.consent,
+		overrides: s.overrides,
+	}
+}
+
+// anonymise decodes the image, finds the faces and redacts them.
+// It returns the redacted image, how to encode it, and a report of what
+// was done.
+func (s *server) anonymise(b []byte, p params, opts options) (image.Image, output, report, error) {
+	release, err := s.acquire()
+	if err != nil {
+		return nil, output{}, report{}, err
+	}
+	defer release()
+	src, err := decodeSource(b)
+	if err != nil {
+		return nil, output{}, report{}, err
+	}
+	out, err := p.output(src.format)
+	if err != nil {
+		return nil, output{}, report{}, statusError{http.StatusBadRequest, err}
+	}
+	if out.restore != "" && s.restoreKey == nil {
+		return nil, output{}, report{}, statusError{http.StatusBadRequest, errors.New("restore: no restore key is set up")}
+	}
+	if p.get("metadata") == "keep" && src.format == "jpeg" && out.format == "jpeg" {
+		out.exif = sanitiseExif(src.exif)
+	}
+	if src.format == "gif" && out.format == "gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			return nil, output{}, report{}, statusError{http.StatusBadRequest, err}
+		}
+		if len(g.Image) > maxFrames {
+			return nil, output{}, report{}, statusError{http.StatusRequestEntityTooLarge, errors.New("image: more than " + strconv.Itoa(maxFrames) + " frames")}
+		}
+		if len(g.Image) > 1 {
+			if out.restore != "" {
+				return nil, output{}, report{}, statusError{http.StatusBadRequest, errors.New("restore: animated GIFs can't be restored")}
+			}
+			anim, rep, err := s.anonymiseGIF(g, opts)
+			if err != nil {
+				return nil, output{}, report{}, err
+			}
+			return anim, out, rep, nil
+		}
+	}
+	found, err := s.detectAll(src.data)
+	if err != nil {
+		return nil, output{}, report{}, err
+	}
+	redactStart := time.Now()
+	anonImg, rep := anonymise(src.img, found, opts)
+	observe("redact", redactStart)
+	if out.restore != "" {
+		out.restoreKey = s.restoreKey
+		if out.original, err = keepOriginal(src.img, rep, opts.feather); err != nil {
+			return nil, output{}, report{}, err
+		}
+	}
+	return anonImg, out, rep, nil
+}
+
+// source is a decoded source image.
+type source struct {
+	img    image.Image
+	format string
+	// exif is the EXIF metadata from JPEG images.
+	exif []byte
+	// data is the image the right way up, in a format Facebox
+	// understands.
+	data []byte
+}
+
+// maxPixels is the most pixels a source image may have, so a small file
+// that claims to be huge can't use up all the memory as it's decoded.
+const maxPixels = 50000000
+
+// decodeSource decodes the image, and turns it the right way up if EXIF
+// says it's on its side, so faces are found and redacted where
+// people will see them.
+func decodeSource(b []byte) (*source, error) {
+	defer observe("decode", time.Now())
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, statusError{http.StatusBadRequest, err}
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, statusError{http.StatusRequestEntityTooLarge, errors.New("image: more than " + strconv.Itoa(maxPixels) + " pixels")}
+	}
+	img, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, statusError{http.StatusBadRequest, err}
+	}
+	src := &source{img: img, format: format, data: b}
+	if format == "jpeg" {
+		src.exif = jpegExif(b)
+		if orientation := exifOrientation(src.exif); orientation > 1 {
+			src.img = orient(img, orientation)
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, src.img, &jpeg.Options{Quality: 95}); err != nil {
+				return nil, err
+			}
+			src.data = buf.Bytes()
+		}
+	}
+	if _, ok := formats[format]; !ok {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		src.data = buf.Bytes()
+	}
+	return src, nil
+}
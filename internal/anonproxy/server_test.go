@@ -0,0 +1,845 @@
+package anonproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/machinebox/toys/signedurl"
+	"github.com/matryer/is"
+	"golang.org/x/image/bmp"
+)
+
+var update = flag.Bool("update", false, "update the golden images in testdata")
+
+// testFaces are the faces the fake Facebox finds: one stranger and one
+// recognised face.
+var testFaces = []facebox.Face{
+	face(8, 8, 16, 16, ""),
+	face(40, 24, 16, 16, "alice"),
+}
+
+// testServer makes a server with the default settings of the flags,
+// using the fake Facebox.
+func testServer(t *testing.T, fb *fakeFacebox) *server {
+	flags := flag.NewFlagSet("anonproxy", flag.ContinueOnError)
+	settings := redactionFlags(flags)
+	outSettings := outputFlags(flags)
+	if err := flags.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	defaults, mask, err := settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outSettings(defaults); err != nil {
+		t.Fatal(err)
+	}
+	fetcher := newFetcher(fetcherOptions{
+		schemes:      "http,https",
+		allowPrivate: true,
+		maxSize:      1 << 20,
+		timeout:      5 * time.Second,
+	})
+	return newServer(fb.client(), fetcher, defaults, mask)
+}
+
+// testImage makes a colourful image, so redactions show up.
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8((x + y) % 8 * 32), 255})
+		}
+	}
+	return img
+}
+
+// testMask is a checked mask for the mask style.
+func testMask() image.Image {
+	mask := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if (x+y)%2 == 0 {
+				mask.Set(x, y, color.RGBA{255, 0, 255, 255})
+			}
+		}
+	}
+	return mask
+}
+
+// encodeTest encodes the test image in the format.
+func encodeTest(t *testing.T, format string) []byte {
+	img := testImage()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "animated":
+		// the picture pans along a frame at a time
+		g := &gif.GIF{}
+		for i := 0; i < 3; i++ {
+			frame := image.NewPaletted(img.Bounds(), palette.Plan9)
+			draw.Draw(frame, frame.Bounds(), img, image.Pt(i*2, 0), draw.Src)
+			g.Image = append(g.Image, frame)
+			g.Delay = append(g.Delay, 10)
+		}
+		err = gif.EncodeAll(&buf, g)
+	case "bmp":
+		err = bmp.Encode(&buf, img)
+	default:
+		t.Fatalf("unknown format %q", format)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sourceServer serves images at paths like /test.png, and other
+// responses at /status/<code>, /loop, /elsewhere and /garbage.
+func sourceServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/status/"):
+			code, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+			if err != nil {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, http.StatusText(code), code)
+		case r.URL.Path == "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case r.URL.Path == "/elsewhere":
+			http.Redirect(w, r, "ftp://example.com/test.png", http.StatusFound)
+		case r.URL.Path == "/garbage":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("this is not an image"))
+		case r.URL.Path == "/truncated.jpg":
+			b := encodeTest(t, "jpeg")
+			w.Write(b[:len(b)/2])
+		default:
+			format := normaliseFormat(strings.TrimPrefix(filepath.Ext(r.URL.Path), "."))
+			if format == "gif" && strings.Contains(r.URL.Path, "animated") {
+				format = "animated"
+			}
+			w.Write(encodeTest(t, format))
+		}
+	}))
+}
+
+// golden checks img is the same as testdata/golden/name.png, or updates
+// the golden image with -update.
+func golden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".png")
+	if *update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%s (run go test -update to make it)", err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePixels(img, want) {
+		t.Errorf("%s: image is different to %s (run go test -update if the change is right)", name, path)
+	}
+}
+
+// samePixels checks that a and b look the same.
+func samePixels(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if color.NRGBAModel.Convert(a.At(x, y)) != color.NRGBAModel.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestStyles(t *testing.T) {
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.mask = testMask()
+	s.overrides = true
+
+	for _, test := range []struct {
+		name  string
+		query string
+	}{
+		{"solid", "style=solid&color=ff0000"},
+		{"blur", "style=blur"},
+		{"pixelate", "style=pixelate&block=4"},
+		{"big-radius", "style=blur&radius=500"},
+		{"mask", "style=mask"},
+		{"ellipse", "shape=ellipse&feather=3&padding=25"},
+		{"rounded", "shape=rounded&padding=25"},
+		{"except", "redact=except&allow=alice"},
+		{"matched", "redact=matched&style=blur"},
+		{"minsize", "minsize=20"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+"/test.png")+"&"+test.query, nil))
+			is.Equal(w.Code, http.StatusOK)
+			is.Equal(w.Header().Get("Content-Type"), "image/png")
+			img, err := png.Decode(w.Body)
+			is.NoErr(err)
+			golden(t, test.name, img)
+		})
+	}
+}
+
+func TestSelectionOverrides(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		defaults string
+		query    string
+		ok       bool
+	}{
+		{"defaults", "redact=unmatched", "", true},
+		{"all", "redact=unmatched", "redact=all", true},
+		{"same", "redact=matched", "redact=matched", true},
+		{"fewer", "redact=all", "redact=matched", false},
+		{"except all", "redact=all", "redact=except&allow=alice", false},
+		{"except unmatched", "redact=unmatched", "redact=except&allow=alice", true},
+		{"consented unmatched", "redact=unmatched", "redact=consented", true},
+		{"consented except", "redact=except&allow=alice", "redact=consented", false},
+		{"shorter allow", "redact=except&allow=alice,bob", "allow=alice", true},
+		{"longer allow", "redact=except&allow=alice", "allow=alice,bob", false},
+		{"other allow", "redact=except&allow=alice", "redact=except&allow=bob", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			defaults := make(map[string]string)
+			values, err := url.ParseQuery(test.defaults)
+			is.NoErr(err)
+			for key := range values {
+				defaults[key] = values.Get(key)
+			}
+			query, err := url.ParseQuery(test.query)
+			is.NoErr(err)
+			_, _, err = params{query: query, defaults: defaults}.selection()
+			is.Equal(err == nil, test.ok)
+			_, _, err = params{query: query, defaults: defaults, overrides: true}.selection()
+			is.NoErr(err) // anything goes with -overrides
+		})
+	}
+}
+
+func TestOptionOverrides(t *testing.T) {
+	defaults := map[string]string{"style": "solid", "padding": "20", "minsize": "10"}
+	for _, test := range []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"padding=50", true},
+		{"padding=10", false},
+		{"padding=-10", false},
+		{"minsize=5", true},
+		{"minsize=20", false},
+		{"minsize=99999", false},
+		{"keyframes=1", true},
+		{"keyframes=2", false},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			is := is.New(t)
+			query, err := url.ParseQuery(test.query)
+			is.NoErr(err)
+			_, err = params{query: query, defaults: defaults}.options()
+			is.Equal(err == nil, test.ok)
+		})
+	}
+	is := is.New(t)
+	_, err := params{query: url.Values{"padding": {"0"}, "minsize": {"20"}}, defaults: defaults, overrides: true}.options()
+	is.NoErr(err)
+	_, err = params{query: url.Values{"minsize": {"99999"}}, defaults: defaults, overrides: true}.options()
+	is.True(err != nil) // still bounded
+	_, err = params{query: url.Values{"keyframes": {"100000"}}, defaults: defaults, overrides: true}.options()
+	is.True(err != nil)
+}
+
+func TestStyleOverrides(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		defaults string
+		query    string
+		ok       bool
+	}{
+		{"defaults", "style=blur", "", true},
+		{"solid", "style=blur", "style=solid", true},
+		{"other style", "style=solid", "style=blur", false},
+		{"pixelate", "style=blur", "style=pixelate", false},
+		{"bigger block", "style=pixelate&block=8", "block=16", true},
+		{"smaller block", "style=pixelate&block=8", "block=1", false},
+		{"block fits face", "style=pixelate&block=8", "block=0", false},
+		{"block instead of fit", "style=pixelate", "block=4", false},
+		{"bigger radius", "style=blur&radius=8", "radius=16", true},
+		{"smaller radius", "style=blur&radius=8", "radius=1", false},
+		{"radius instead of fit", "style=blur", "radius=1", false},
+		{"rect", "style=solid&shape=ellipse", "shape=rect", true},
+		{"rounded", "style=solid&shape=rounded", "shape=ellipse", false},
+		{"ellipse", "style=solid", "shape=ellipse", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			defaults := make(map[string]string)
+			values, err := url.ParseQuery(test.defaults)
+			is.NoErr(err)
+			for key := range values {
+				defaults[key] = values.Get(key)
+			}
+			query, err := url.ParseQuery(test.query)
+			is.NoErr(err)
+			_, err = params{query: query, defaults: defaults}.options()
+			is.Equal(err == nil, test.ok)
+			_, err = params{query: query, defaults: defaults, overrides: true}.options()
+			is.NoErr(err) // anything goes with -overrides
+		})
+	}
+}
+
+func TestLabelOverrides(t *testing.T) {
+	defaults := map[string]string{"style": "solid", "labels": "plate,text"}
+	for _, test := range []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"labels=plate,text", true},
+		{"labels=text,plate,sign", true},
+		{"labels=*", true},
+		{"labels=plate", false},
+		{"labels=none", false},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			is := is.New(t)
+			query, err := url.ParseQuery(test.query)
+			is.NoErr(err)
+			_, err = params{query: query, defaults: defaults}.options()
+			is.Equal(err == nil, test.ok)
+			_, err = params{query: query, defaults: defaults, overrides: true}.options()
+			is.NoErr(err) // anything goes with -overrides
+		})
+	}
+}
+
+func TestSmallestBlockAndRadius(t *testing.T) {
+	for _, redactor := range []Redactor{pixelateRedactor{block: 1}, blurRedactor{radius: 1}} {
+		is := is.New(t)
+		img := image.NewRGBA(image.Rect(0, 0, 48, 48))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i * 37)
+		}
+		before := image.NewRGBA(img.Bounds())
+		copy(before.Pix, img.Pix)
+		redactor.Redact(img, img.Bounds())
+		var changed int
+		for i := range img.Pix {
+			if img.Pix[i] != before.Pix[i] {
+				changed++
+			}
+		}
+		is.True(changed > len(img.Pix)/2) // the face is obscured however small the block or radius
+	}
+}
+
+func TestFormats(t *testing.T) {
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+
+	for _, test := range []struct {
+		name        string
+		path        string
+		query       string
+		contentType string
+	}{
+		{"png", "/test.png", "", "image/png"},
+		{"jpeg", "/test.jpg", "", "image/jpeg"},
+		{"gif", "/test.gif", "", "image/gif"},
+		{"bmp-fallback", "/test.bmp", "", "image/png"},
+		{"png-to-jpeg", "/test.png", "format=jpeg&quality=80", "image/jpeg"},
+		{"animated-first-frame", "/animated.gif", "format=png", "image/png"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+test.path)+"&"+test.query, nil))
+			is.Equal(w.Code, http.StatusOK)
+			is.Equal(w.Header().Get("Content-Type"), test.contentType)
+			img, _, err := image.Decode(w.Body)
+			is.NoErr(err)
+			golden(t, test.name, img)
+		})
+	}
+}
+
+func TestAnimatedGIF(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.defaults["keyframes"] = "2"
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+"/animated.gif"), nil))
+	is.Equal(w.Code, http.StatusOK)
+	g, err := gif.DecodeAll(w.Body)
+	is.NoErr(err)
+	is.Equal(len(g.Image), 3)
+	is.Equal(g.Delay, []int{10, 10, 10})
+	is.Equal(fb.checked(), 2) // the middle frame is tracked
+	for i, frame := range g.Image {
+		golden(t, "animated-"+strconv.Itoa(i), frame)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	s := testServer(t, fb)
+	s.defaults["style"] = "pixelate"
+	s.defaults["block"] = "4"
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/anonymise", bytes.NewReader(encodeTest(t, "png"))))
+	is.Equal(w.Code, http.StatusOK)
+	img, err := png.Decode(w.Body)
+	is.NoErr(err)
+	golden(t, "pixelate", img) // same as the proxy
+
+	s.defaults["redact"] = "except"
+	s.defaults["allow"] = "alice"
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/faces", bytes.NewReader(encodeTest(t, "png"))))
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `"redacted":1`))
+	is.True(strings.Contains(w.Body.String(), `"name":"alice"`))
+}
+
+func TestErrors(t *testing.T) {
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	srcURL := func(path string) string {
+		return url.QueryEscape(src.URL + path)
+	}
+
+	for _, test := range []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"missing src", "GET", "/", "", http.StatusBadRequest},
+		{"relative src", "GET", "/?src=/test.png", "", http.StatusBadRequest},
+		{"bad scheme", "GET", "/?src=" + url.QueryEscape("ftp://example.com/test.png"), "", http.StatusForbidden},
+		{"bad url", "GET", "/?src=" + url.QueryEscape("http://[::1"), "", http.StatusBadRequest},
+		{"not found upstream", "GET", "/?src=" + srcURL("/status/404"), "", http.StatusNotFound},
+		{"gone upstream", "GET", "/?src=" + srcURL("/status/410"), "", http.StatusNotFound},
+		{"failing upstream", "GET", "/?src=" + srcURL("/status/500"), "", http.StatusBadGateway},
+		{"unavailable upstream", "GET", "/?src=" + srcURL("/status/503"), "", http.StatusBadGateway},
+		{"forbidden upstream", "GET", "/?src=" + srcURL("/status/403"), "", http.StatusBadGateway},
+		{"redirect loop", "GET", "/?src=" + srcURL("/loop"), "", http.StatusBadGateway},
+		{"bad redirect", "GET", "/?src=" + srcURL("/elsewhere"), "", http.StatusForbidden},
+		{"not an image", "GET", "/?src=" + srcURL("/garbage"), "", http.StatusBadRequest},
+		{"truncated image", "GET", "/?src=" + srcURL("/truncated.jpg"), "", http.StatusBadRequest},
+		{"bad style", "GET", "/?src=" + srcURL("/test.png") + "&style=sparkles", "", http.StatusBadRequest},
+		{"huge radius", "GET", "/?src=" + srcURL("/test.png") + "&style=blur&radius=1000000000", "", http.StatusBadRequest},
+		{"huge block", "GET", "/?src=" + srcURL("/test.png") + "&style=pixelate&block=1000000000", "", http.StatusBadRequest},
+		{"fewer faces", "GET", "/?src=" + srcURL("/test.png") + "&redact=matched", "", http.StatusBadRequest},
+		{"huge minsize", "GET", "/?src=" + srcURL("/test.png") + "&minsize=99999", "", http.StatusBadRequest},
+		{"huge padding", "GET", "/?src=" + srcURL("/test.png") + "&padding=1000", "", http.StatusBadRequest},
+		{"huge feather", "GET", "/?src=" + srcURL("/test.png") + "&feather=1000", "", http.StatusBadRequest},
+		{"bigger minsize", "GET", "/?src=" + srcURL("/test.png") + "&minsize=20", "", http.StatusBadRequest},
+		{"bad format", "GET", "/?src=" + srcURL("/test.png") + "&format=tiff", "", http.StatusBadRequest},
+		{"upload not an image", "POST", "/anonymise", "this is not an image", http.StatusBadRequest},
+		{"empty upload", "POST", "/anonymise", "", http.StatusBadRequest},
+		{"get anonymise", "GET", "/anonymise", "", http.StatusMethodNotAllowed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+			is.Equal(w.Code, test.status)
+		})
+	}
+	is := is.New(t)
+	is.Equal(fb.checked(), 0) // nothing got as far as Facebox
+}
+
+func TestSigned(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.secret = []byte("secret")
+	link, err := signedurl.Sign("GET", "/?src="+url.QueryEscape(src.URL+"/test.png"), s.secret, time.Now().Add(time.Hour))
+	is.NoErr(err)
+	u, err := url.Parse(link)
+	is.NoErr(err)
+	do := func(method, target string, body []byte) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		return w.Code
+	}
+
+	is.Equal(do("GET", link, nil), http.StatusOK)
+	is.Equal(do("HEAD", link, nil), http.StatusOK)
+	is.Equal(do("GET", "/?src="+url.QueryEscape(src.URL+"/test.png"), nil), http.StatusForbidden) // unsigned
+	query := u.Query()
+	query.Set("redact", "matched")
+	is.Equal(do("GET", "/?"+query.Encode(), nil), http.StatusForbidden) // altered
+
+	// the signature is only good for the path and method it was made for
+	is.Equal(do("GET", "/faces?"+u.RawQuery, nil), http.StatusForbidden)
+	is.Equal(do("POST", link, encodeTest(t, "png")), http.StatusForbidden)
+	is.Equal(do("POST", "/anonymise?"+u.RawQuery, encodeTest(t, "png")), http.StatusForbidden)
+	is.Equal(do("POST", "/deanonymise?"+u.RawQuery, encodeTest(t, "png")), http.StatusForbidden)
+
+	// uploads can't be signed
+	upload, err := signedurl.Sign("POST", "/anonymise", s.secret, time.Time{})
+	is.NoErr(err)
+	is.Equal(do("POST", upload, encodeTest(t, "png")), http.StatusForbidden)
+	is.Equal(fb.checked(), 2)
+
+	// monitoring isn't signed
+	is.Equal(do("GET", "/healthz", nil), http.StatusOK)
+}
+
+func TestPrivateSrc(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.fetcher = newFetcher(fetcherOptions{schemes: "http", maxSize: 1 << 20, timeout: 5 * time.Second})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+"/test.png"), nil))
+	is.Equal(w.Code, http.StatusForbidden)
+
+	// names are checked once they're resolved
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(strings.Replace(src.URL, "127.0.0.1", "localhost", 1)+"/test.png"), nil))
+	is.Equal(w.Code, http.StatusForbidden)
+}
+
+func TestTooLarge(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.fetcher = newFetcher(fetcherOptions{schemes: "http", allowPrivate: true, maxSize: 100, timeout: 5 * time.Second})
+	s.maxSize = 100
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+"/test.png"), nil))
+	is.Equal(w.Code, http.StatusRequestEntityTooLarge)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/anonymise", bytes.NewReader(encodeTest(t, "png"))))
+	is.Equal(w.Code, http.StatusRequestEntityTooLarge)
+
+	// too many frames
+	s.maxSize = 0
+	g := &gif.GIF{}
+	for i := 0; i <= maxFrames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}))
+		g.Delay = append(g.Delay, 1)
+	}
+	var buf bytes.Buffer
+	is.NoErr(gif.EncodeAll(&buf, g))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/anonymise", &buf))
+	is.Equal(w.Code, http.StatusRequestEntityTooLarge)
+	is.Equal(fb.checked(), 0)
+
+	// a small file that claims to be huge
+	buf.Reset()
+	is.NoErr(png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))))
+	bomb := buf.Bytes()
+	binary.BigEndian.PutUint32(bomb[16:], 100000) // IHDR width
+	binary.BigEndian.PutUint32(bomb[20:], 100000) // IHDR height
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/anonymise", bytes.NewReader(bomb)))
+	is.Equal(w.Code, http.StatusRequestEntityTooLarge)
+}
+
+func TestFaceboxErrors(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	src := sourceServer(t)
+	defer src.Close()
+	s := testServer(t, fb)
+	s.cache = newCache(1<<20, "")
+	fb.fail(http.StatusInternalServerError)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+"/test.png"), nil))
+	is.Equal(w.Code, http.StatusInternalServerError)
+	is.True(strings.HasPrefix(w.Body.String(), "facebox: "))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/faces", bytes.NewReader(encodeTest(t, "png"))))
+	is.Equal(w.Code, http.StatusInternalServerError)
+
+	// failures aren't cached
+	fb.fail(0)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?src="+url.QueryEscape(src.URL+"/test.png"), nil))
+	is.Equal(w.Code, http.StatusOK)
+}
+
+func TestDiskCache(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	c := newCache(0, dir)
+	for _, key := range []string{"a", "b", "c"} {
+		c.put(key, &cacheEntry{Body: bytes.Repeat([]byte(key), 1000)})
+	}
+	exists := func(key string) bool {
+		_, err := os.Stat(c.path(key))
+		return err == nil
+	}
+	age := func(key string, d time.Duration) {
+		then := time.Now().Add(-d)
+		is.NoErr(os.Chtimes(c.path(key), then, then))
+	}
+	info, err := os.Stat(c.path("a"))
+	is.NoErr(err)
+	age("a", 3*time.Hour)
+	age("b", 2*time.Hour)
+	_, ok := c.get("a") // a is used, so b is now the oldest
+	is.True(ok)
+
+	c.dirMaxSize = info.Size() * 5 / 2
+	c.sweep()
+	is.True(exists("a"))
+	is.True(!exists("b"))
+	is.True(exists("c"))
+
+	c.dirMaxAge = time.Hour
+	age("c", 2*time.Hour)
+	c.sweep()
+	is.True(exists("a"))
+	is.True(!exists("c"))
+	_, ok = c.get("c")
+	is.True(!ok)
+}
+
+func TestSettingsKey(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	key := testServer(t, fb).settingsKey()
+	is.Equal(testServer(t, fb).settingsKey(), key) // the same after a restart
+
+	s := testServer(t, fb)
+	s.mask = testMask()
+	is.True(s.settingsKey() != key)
+	s = testServer(t, fb)
+	s.detectors = []Detector{httpDetector{url: "http://localhost:9000/plates"}}
+	plates := s.settingsKey()
+	is.True(plates != key)
+	s = testServer(t, fb)
+	s.detectors = []Detector{httpDetector{url: "http://localhost:9000/text"}}
+	is.True(s.settingsKey() != plates)
+	s = testServer(t, fb)
+	s.restoreKey = make([]byte, 32)
+	is.True(s.settingsKey() != key)
+}
+
+func TestRestore(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	s := testServer(t, fb)
+	s.restoreKey = make([]byte, 32)
+	s.defaults["restore"] = "png"
+	anonymised := func() []byte {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/anonymise", bytes.NewReader(encodeTest(t, "png"))))
+		is.Equal(w.Code, http.StatusOK)
+		return w.Body.Bytes()
+	}
+
+	solid := anonymised()
+	img, err := restoreImage(solid, nil, s.restoreKey)
+	is.NoErr(err)
+	is.True(samePixels(img, testImage()))
+	_, err = restoreImage(solid, nil, make([]byte, 16))
+	is.True(err != nil) // wrong key
+
+	// the sealed faces can't be moved onto another image
+	s.defaults["style"] = "blur"
+	blurred := withoutPNGChunk(anonymised(), restoreChunk)
+	moved, err := addPNGChunk(blurred, restoreChunk, pngChunk(solid, restoreChunk))
+	is.NoErr(err)
+	_, err = restoreImage(moved, nil, s.restoreKey)
+	is.True(err != nil)
+	_, err = restoreImage(blurred, pngChunk(solid, restoreChunk), s.restoreKey)
+	is.True(err != nil)
+}
+
+func TestBatchOutputPaths(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	s := testServer(t, fb)
+	b := &batch{server: s, params: params{defaults: s.defaults}, out: dir}
+	b.opts, err = b.params.options()
+	is.NoErr(err)
+	b.index([]string{"a.bmp", "a.png", "b.bmp", filepath.Join("c", "a.bmp")})
+	is.NoErr(os.Mkdir(filepath.Join(dir, "c"), 0755))
+
+	for _, test := range []struct {
+		src, format, out string
+	}{
+		{"a.png", "png", "a.png"},
+		{"a.bmp", "bmp", "a.bmp.png"}, // a.png is taken
+		{"b.bmp", "bmp", "b.png"},
+		{filepath.Join("c", "a.bmp"), "bmp", filepath.Join("c", "a.png")},
+	} {
+		out, _, _, err := b.anonymise(encodeTest(t, test.format), test.src)
+		is.NoErr(err)
+		is.Equal(out, test.out)
+	}
+	// both are still there
+	for _, path := range []string{"a.png", "a.bmp.png", "b.png", filepath.Join("c", "a.png")} {
+		_, err := os.Stat(filepath.Join(dir, path))
+		is.NoErr(err)
+	}
+
+	b.index([]string{"a.bmp", "a.png", "a.bmp.png"})
+	_, err = b.outputPath("a.bmp", "png")
+	is.True(err != nil) // nowhere left to write it
+}
+
+func TestBatchSettings(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	src, out := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+	is.NoErr(os.Mkdir(src, 0755))
+	is.NoErr(ioutil.WriteFile(filepath.Join(src, "a.png"), encodeTest(t, "png"), 0644))
+	s := testServer(t, fb)
+	b := &batch{server: s, params: params{defaults: s.defaults}, src: src, out: out}
+	b.opts, err = b.params.options()
+	is.NoErr(err)
+	b.index([]string{"a.png"})
+	b.settings = b.params.values().Encode()
+	b.key = s.settingsKey()
+
+	done, err := b.anonymiseFile("a.png")
+	is.NoErr(err)
+	is.True(done)
+	done, err = b.anonymiseFile("a.png")
+	is.NoErr(err)
+	is.True(!done) // already done with the same settings
+
+	// a new mask isn't a parameter, but still changes the output
+	masked := testServer(t, fb)
+	masked.mask = testMask()
+	b.key = masked.settingsKey()
+	done, err = b.anonymiseFile("a.png")
+	is.NoErr(err)
+	is.True(done)
+}
+
+func TestAdmin(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox(testFaces...)
+	defer fb.Close()
+	s := testServer(t, fb)
+	s.secret = []byte("secret")
+	get := func(h http.Handler, target string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+
+	var logged bytes.Buffer
+	accessLog.SetOutput(&logged)
+	defer accessLog.SetOutput(os.Stderr)
+	s.accessLog = true
+	is.Equal(get(s, "/metrics"), http.StatusForbidden)              // not on the public listener
+	is.True(strings.Contains(logged.String(), `"path":"/metrics"`)) // and logged like any other unknown path
+	is.Equal(get(s.admin(), "/metrics"), http.StatusOK)
+	is.Equal(get(s.admin(), "/consent"), http.StatusNotFound)
+
+	dir, err := ioutil.TempDir("", "anonproxy")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	s.consent, err = loadConsent(filepath.Join(dir, "consent.json"))
+	is.NoErr(err)
+	is.Equal(get(s.admin(), "/consent"), http.StatusOK)
+}
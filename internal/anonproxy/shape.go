@@ -0,0 +1,269 @@
+package anonproxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// options control how faces are redacted.
+type options struct {
+	// style is the name of the redaction style.
+	style    string
+	redactor Redactor
+	// padding is added around each face, as a percentage of the
+	// face size.
+	padding float64
+	// shape is the shape of the redaction (rect, ellipse or rounded).
+	shape string
+	// feather is the width in pixels of the soft edge.
+	feather int
+	// minSize is the smallest face (width or height in pixels)
+	// that will be redacted.
+	minSize int
+	// selection is which faces are redacted (see selections).
+	selection string
+	// allow are the names and IDs of recognised faces that are left
+	// alone by the except selection.
+	allow map[string]bool
+	// consent is the consent registry, or nil if there isn't one.
+	consent *consentRegistry
+	// labels are the labels of objects found by detectors that are
+	// redacted, or * for all of them.
+	labels map[string]bool
+	// keyframes is how often faces are found in animated GIFs; every
+	// frame (1), every other frame (2), and so on.
+	keyframes int
+}
+
+// maxPadding, maxFeather, maxMinSize and maxKeyframes are the largest
+// padding (as a percentage), feather and minimum face size (in pixels)
+// and gap between keyframes allowed.
+const (
+	maxPadding   = 100
+	maxFeather   = 100
+	maxMinSize   = 1000
+	maxKeyframes = 25
+)
+
+// shapes are the supported redaction shapes, and their signed distance
+// functions.
+var shapes = map[string]func(r image.Rectangle, x, y float64) float64{
+	"rect":    rectDistance,
+	"ellipse": ellipseDistance,
+	"rounded": roundedDistance,
+}
+
+// shapeCoverage ranks the shapes by how much of the area they cover.
+var shapeCoverage = map[string]int{
+	"ellipse": 0,
+	"rounded": 1,
+	"rect":    2,
+}
+
+// options gets the options for the request.
+func (p params) options() (options, error) {
+	var opts options
+	var err error
+	opts.style = p.get("style")
+	opts.redactor, err = p.redactor()
+	if err != nil {
+		return opts, err
+	}
+	opts.shape = p.get("shape")
+	if opts.shape == "" {
+		opts.shape = "rect"
+	}
+	if _, ok := shapes[opts.shape]; !ok {
+		return opts, errors.New("shape: unknown shape " + strconv.Quote(opts.shape))
+	}
+	if opts.padding, err = p.float("padding"); err != nil {
+		return opts, err
+	}
+	if opts.feather, err = p.int("feather"); err != nil {
+		return opts, err
+	}
+	if opts.minSize, err = p.int("minsize"); err != nil {
+		return opts, err
+	}
+	if opts.keyframes, err = p.int("keyframes"); err != nil {
+		return opts, err
+	}
+	if opts.padding < 0 || opts.feather < 0 || opts.minSize < 0 || opts.keyframes < 0 {
+		return opts, errors.New("padding, feather, minsize and keyframes must be positive")
+	}
+	switch {
+	case opts.padding > maxPadding:
+		return opts, errors.New("padding: can be at most " + strconv.Itoa(maxPadding))
+	case opts.feather > maxFeather:
+		return opts, errors.New("feather: can be at most " + strconv.Itoa(maxFeather))
+	case opts.minSize > maxMinSize:
+		return opts, errors.New("minsize: can be at most " + strconv.Itoa(maxMinSize))
+	case opts.keyframes > maxKeyframes:
+		return opts, errors.New("keyframes: can be at most " + strconv.Itoa(maxKeyframes))
+	}
+	if !p.overrides {
+		// the query may only cover more of the faces than the defaults
+		defaults := params{defaults: p.defaults}
+		padding, err := defaults.float("padding")
+		if err != nil {
+			return opts, err
+		}
+		minSize, err := defaults.int("minsize")
+		if err != nil {
+			return opts, err
+		}
+		if opts.padding < padding {
+			return opts, errors.New("padding: can't be less than " + strconv.FormatFloat(padding, 'f', -1, 64) + " (see -overrides)")
+		}
+		if opts.minSize > minSize {
+			return opts, errors.New("minsize: can't be more than " + strconv.Itoa(minSize) + " (see -overrides)")
+		}
+		keyframes, err := defaults.int("keyframes")
+		if err != nil {
+			return opts, err
+		}
+		if opts.keyframes > max(keyframes, 1) {
+			return opts, errors.New("keyframes: can't be more than " + strconv.Itoa(max(keyframes, 1)) + " (see -overrides)")
+		}
+		if err := defaults.covered(opts); err != nil {
+			return opts, err
+		}
+	}
+	if opts.selection, opts.allow, err = p.selection(); err != nil {
+		return opts, err
+	}
+	if opts.labels, err = p.labels(); err != nil {
+		return opts, err
+	}
+	opts.consent = p.consent
+	return opts, nil
+}
+
+// covered checks opts redact at least as much of each face as the
+// style and shape of the defaults in p. The solid style covers
+// everything, otherwise the style must be the same, with a block or
+// radius no smaller than the default.
+func (p params) covered(opts options) error {
+	style := p.get("style")
+	if opts.style != style && opts.style != "solid" {
+		return errors.New("style: can only be " + strconv.Quote(style) + " or \"solid\" (see -overrides)")
+	}
+	shape := p.get("shape")
+	if shape == "" {
+		shape = "rect"
+	}
+	if shapeCoverage[opts.shape] < shapeCoverage[shape] {
+		return errors.New("shape: can't cover less than " + strconv.Quote(shape) + " (see -overrides)")
+	}
+	if opts.style != style {
+		return nil
+	}
+	// zero sizes the block or radius to the face, which a fixed size
+	// can't be compared with
+	var key string
+	var size int
+	switch r := opts.redactor.(type) {
+	case pixelateRedactor:
+		key, size = "block", r.block
+	case blurRedactor:
+		key, size = "radius", r.radius
+	default:
+		return nil
+	}
+	defaultSize, err := p.int(key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case size == defaultSize:
+	case defaultSize == 0:
+		return errors.New(key + ": can't replace the size that fits the face (see -overrides)")
+	case size < defaultSize:
+		return errors.New(key + ": can't be less than " + strconv.Itoa(defaultSize) + " (see -overrides)")
+	}
+	return nil
+}
+
+// area gets the area to redact for the face rectangle, or false
+// if the face should be left alone.
+func (o options) area(face image.Rectangle, bounds image.Rectangle) (image.Rectangle, bool) {
+	if face.Dx() < o.minSize || face.Dy() < o.minSize {
+		return image.ZR, false
+	}
+	padX := int(math.Round(float64(face.Dx()) * o.padding / 100))
+	padY := int(math.Round(float64(face.Dy()) * o.padding / 100))
+	area := image.Rect(face.Min.X-padX, face.Min.Y-padY, face.Max.X+padX, face.Max.Y+padY)
+	area = area.Intersect(bounds)
+	return area, !area.Empty()
+}
+
+// redact redacts the shape filling the area r of img.
+// The feathered edge is outside of r, so the whole area is covered.
+func (o options) redact(img *image.RGBA, r image.Rectangle) {
+	if o.shape == "rect" && o.feather == 0 {
+		o.redactor.Redact(img, r)
+		return
+	}
+	outer := r.Inset(-o.feather).Intersect(img.Bounds())
+	redacted := image.NewRGBA(outer)
+	draw.Draw(redacted, outer, img, outer.Min, draw.Src)
+	o.redactor.Redact(redacted, outer)
+	mask := shapeMask(o.shape, r, outer, o.feather)
+	draw.DrawMask(img, outer, redacted, outer.Min, mask, outer.Min, draw.Over)
+}
+
+// shapeMask makes a mask covering outer for the shape filling r, that
+// fades out over feather pixels beyond the edge of the shape.
+func shapeMask(shape string, r, outer image.Rectangle, feather int) *image.Alpha {
+	distance := shapes[shape]
+	mask := image.NewAlpha(outer)
+	for y := outer.Min.Y; y < outer.Max.Y; y++ {
+		for x := outer.Min.X; x < outer.Max.X; x++ {
+			// distance from the pixel centre to the edge,
+			// positive inside the shape
+			d := distance(r, float64(x)+0.5, float64(y)+0.5)
+			var a float64
+			switch {
+			case d >= 0:
+				a = 1
+			case feather > 0:
+				a = math.Max(0, 1+d/float64(feather))
+			}
+			mask.SetAlpha(x, y, color.Alpha{uint8(a * 0xff)})
+		}
+	}
+	return mask
+}
+
+func rectDistance(r image.Rectangle, x, y float64) float64 {
+	return math.Min(
+		math.Min(x-float64(r.Min.X), float64(r.Max.X)-x),
+		math.Min(y-float64(r.Min.Y), float64(r.Max.Y)-y),
+	)
+}
+
+// ellipseDistance approximates the distance to the edge of the ellipse
+// inside r.
+func ellipseDistance(r image.Rectangle, x, y float64) float64 {
+	a, b := float64(r.Dx())/2, float64(r.Dy())/2
+	dx := (x - float64(r.Min.X) - a) / a
+	dy := (y - float64(r.Min.Y) - b) / b
+	return (1 - math.Sqrt(dx*dx+dy*dy)) * math.Min(a, b)
+}
+
+// roundedDistance is the distance to the edge of a rectangle with
+// corners rounded to a quarter of its shortest side.
+func roundedDistance(r image.Rectangle, x, y float64) float64 {
+	halfW, halfH := float64(r.Dx())/2, float64(r.Dy())/2
+	radius := math.Min(halfW, halfH) / 2
+	qx := math.Abs(x-float64(r.Min.X)-halfW) - (halfW - radius)
+	qy := math.Abs(y-float64(r.Min.Y)-halfH) - (halfH - radius)
+	outside := math.Hypot(math.Max(qx, 0), math.Max(qy, 0))
+	inside := math.Min(math.Max(qx, qy), 0)
+	return -(outside + inside - radius)
+}
@@ -0,0 +1,33 @@
+package anonproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/machinebox/toys/signedurl"
+)
+
+// requireSigned rejects requests to h that aren't signed with the
+// secret, or that have expired.
+// Signed links are for GET requests, so uploads aren't allowed at all.
+func (s *server) requireSigned(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.secret == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		if method != http.MethodGet {
+			http.Error(w, "uploads are turned off because requests must be signed", http.StatusForbidden)
+			return
+		}
+		if err := signedurl.Verify(method, r.URL.Path, r.URL.Query(), s.secret, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,390 @@
+package anonproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+)
+
+// videoSummary describes the anonvideo command in help output.
+const videoSummary = "Anonymise the faces in a video using Facebox + ffmpeg"
+
+// VideoCommand is the anonvideo command.
+var VideoCommand = cli.Command{
+	Name:    "anonvideo",
+	Summary: videoSummary,
+	Run:     RunVideo,
+}
+
+// RunVideo anonymises the video file in args.
+// ffmpeg decodes the frames, faces are found in every few frames and
+// tracked in between, and the redacted frames are encoded again with
+// the original audio.
+func RunVideo(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("anonvideo", videoSummary+".\nusage: anonvideo [flags] video-file")
+	var (
+		faceboxAddr = flags.String("facebox", "http://localhost:8080", "Facebox address")
+		settings    = redactionFlags(flags)
+		detectors   = detectorFlags(flags)
+		outFile     = flags.String("out", "", "output file (default will save file next to original)")
+		keyframes   = flags.Int("keyframes", 5, "how often to find faces (1 checks every frame, 2 every other frame and tracks faces in between, and so on)")
+		crf         = flags.Int("crf", 18, "x264 quality of the output video (0-51, lower is better)")
+		preset      = flags.String("preset", "medium", "x264 preset, trading encoding speed for file size")
+	)
+	if ok, err := config.Parse("anonvideo", flags, args); !ok {
+		return err
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		return errors.New("specify a video file")
+	}
+	inFile := args[0]
+	if *keyframes < 1 {
+		return errors.New("keyframes must be at least 1")
+	}
+	defaults, mask, err := settings()
+	if err != nil {
+		return err
+	}
+	opts, err := (params{defaults: defaults, mask: mask}).options()
+	if err != nil {
+		return err
+	}
+	opts.keyframes = *keyframes
+	info, err := probeVideo(ctx, inFile)
+	if err != nil {
+		return err
+	}
+	output := *outFile
+	if output == "" {
+		ext := filepath.Ext(inFile)
+		output = inFile[:len(inFile)-len(ext)] + "-anonymised" + ext
+	}
+	fb, err := cli.Facebox(ctx, *faceboxAddr)
+	if err != nil {
+		return err
+	}
+	ds, err := detectors(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	size := strconv.Itoa(info.width) + "x" + strconv.Itoa(info.height)
+	var decodeErr, encodeErr bytes.Buffer
+	decoder := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error", "-i", inFile,
+		// every frame once, as it is in the source; the frames are
+		// timed to the output rate by their timestamps (see copies)
+		"-map", "0:v:0", "-fps_mode", "passthrough",
+		"-f", "rawvideo", "-pix_fmt", "rgba", "-",
+	)
+	decoder.Stderr = &decodeErr
+	frames, err := decoder.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	encoder := exec.CommandContext(ctx, "ffmpeg",
+		"-y", "-v", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgba", "-s", size, "-r", info.rate, "-i", "-",
+		"-i", inFile,
+		"-map", "0:v", "-map", "1:a?", "-c:a", "copy",
+		"-c:v", "libx264", "-preset", *preset, "-crf", strconv.Itoa(*crf),
+		// yuv420p needs even dimensions
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2", "-pix_fmt", "yuv420p",
+		output,
+	)
+	encoder.Stderr = &encodeErr
+	redacted, err := encoder.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := decoder.Start(); err != nil {
+		return errors.Wrap(err, "ffmpeg")
+	}
+	if err := encoder.Start(); err != nil {
+		return errors.Wrap(err, "ffmpeg")
+	}
+	fmt.Printf("anonymising %s into %s...\n", inFile, output)
+	v := &videoAnonymiser{
+		server: &server{fb: fb, detectors: ds},
+		opts:   opts,
+		bounds: image.Rect(0, 0, info.width, info.height),
+		times:  info.times,
+		fps:    info.fps,
+		progress: func(frame int) {
+			if info.frames > 0 {
+				fmt.Printf("\r%d%% complete...", clamp(100*frame/info.frames, 0, 100))
+				return
+			}
+			fmt.Printf("\r%d frames...", frame)
+		},
+	}
+	stats, err := v.anonymise(frames, redacted)
+	fmt.Println()
+	redacted.Close()
+	if err != nil {
+		cancel()
+		decoder.Wait()
+		if encoder.Wait() != nil && encodeErr.Len() > 0 {
+			return errors.Wrap(err, "ffmpeg: "+encodeErr.String())
+		}
+		return err
+	}
+	if err := decoder.Wait(); err != nil {
+		return errors.Wrap(err, "ffmpeg: "+decodeErr.String())
+	}
+	if err := encoder.Wait(); err != nil {
+		return errors.Wrap(err, "ffmpeg: "+encodeErr.String())
+	}
+	fmt.Printf("Frames:     %d\n", stats.frames)
+	fmt.Printf("Checked:    %d\n", stats.checked)
+	fmt.Printf("Redactions: %d\n", stats.redacted)
+	fmt.Println("done.")
+	return nil
+}
+
+// videoInfo describes the video stream of a video file.
+type videoInfo struct {
+	// width and height are the size of the frames, the right way up.
+	width, height int
+	// rate is the frame rate, like 30000/1001, and fps is the same
+	// as a number.
+	rate string
+	fps  float64
+	// frames is the number of frames, or 0 if it isn't known.
+	frames int
+	// times are the times of the frames in seconds, in the order
+	// they are shown.
+	times []float64
+}
+
+// probeVideo gets the video stream info of the file with ffprobe.
+func probeVideo(ctx context.Context, file string) (videoInfo, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,r_frame_rate,nb_frames:stream_tags=rotate:stream_side_data=rotation:packet=pts_time",
+		"-of", "json", file,
+	).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return videoInfo{}, errors.Wrap(err, "ffprobe: "+string(exitErr.Stderr))
+		}
+		return videoInfo{}, errors.Wrap(err, "ffprobe")
+	}
+	return parseProbe(out)
+}
+
+// parseProbe parses the JSON output of ffprobe.
+func parseProbe(b []byte) (videoInfo, error) {
+	var probe struct {
+		Streams []struct {
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			FrameRate string `json:"r_frame_rate"`
+			Frames    string `json:"nb_frames"`
+			Tags      struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideData []struct {
+				Rotation int `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Packets []struct {
+			Time string `json:"pts_time"`
+		} `json:"packets"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return videoInfo{}, errors.Wrap(err, "ffprobe")
+	}
+	if len(probe.Streams) == 0 {
+		return videoInfo{}, errors.New("no video stream")
+	}
+	stream := probe.Streams[0]
+	if stream.Width <= 0 || stream.Height <= 0 || stream.FrameRate == "" || strings.HasPrefix(stream.FrameRate, "0/") {
+		return videoInfo{}, errors.New("cannot tell the size and frame rate of the video")
+	}
+	info := videoInfo{
+		width:  stream.Width,
+		height: stream.Height,
+		rate:   stream.FrameRate,
+	}
+	info.frames, _ = strconv.Atoi(stream.Frames)
+	if rate := strings.SplitN(stream.FrameRate, "/", 2); len(rate) == 2 {
+		num, _ := strconv.ParseFloat(rate[0], 64)
+		den, _ := strconv.ParseFloat(rate[1], 64)
+		if den > 0 {
+			info.fps = num / den
+		}
+	}
+	for _, packet := range probe.Packets {
+		t, err := strconv.ParseFloat(packet.Time, 64)
+		if err != nil {
+			// without every timestamp, frames are shown at the
+			// frame rate
+			info.times = nil
+			break
+		}
+		info.times = append(info.times, t)
+	}
+	// packets are in decoding order
+	sort.Float64s(info.times)
+	// ffmpeg turns the frames the right way up as it decodes them
+	rotation, _ := strconv.Atoi(stream.Tags.Rotate)
+	for _, sideData := range stream.SideData {
+		if sideData.Rotation != 0 {
+			rotation = sideData.Rotation
+		}
+	}
+	if rotation%180 != 0 {
+		info.width, info.height = info.height, info.width
+	}
+	return info, nil
+}
+
+// videoAnonymiser redacts the faces in raw RGBA video frames.
+type videoAnonymiser struct {
+	server *server
+	opts   options
+	bounds image.Rectangle
+	// times are the times of the frames in the source, and fps is
+	// the frame rate of the output (see copies).
+	times []float64
+	fps   float64
+	// progress is called with the number of frames done so far.
+	progress func(frame int)
+	// free are frames that can be used again.
+	free []*image.RGBA
+}
+
+// videoStats describes what was done to a video.
+type videoStats struct {
+	frames   int
+	checked  int
+	redacted int
+}
+
+// anonymise reads frames from r, and writes them to w with the faces
+// redacted.
+// Faces are found in every opts.keyframes frames, and in the last frame,
+// so the frames in between are held back until the faces at both ends
+// are known.
+func (v *videoAnonymiser) anonymise(r io.Reader, w io.Writer) (videoStats, error) {
+	var (
+		stats     videoStats
+		pending   []*image.RGBA
+		lastFound detections
+	)
+	for i := 0; ; i++ {
+		frame := v.frame()
+		if _, err := io.ReadFull(r, frame.Pix); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return stats, errors.Wrap(err, "reading frames")
+		}
+		stats.frames++
+		if i%v.opts.keyframes != 0 {
+			pending = append(pending, frame)
+			continue
+		}
+		found, err := v.check(frame, &stats)
+		if err != nil {
+			return stats, err
+		}
+		if err := v.track(w, append(pending, frame), lastFound, found, &stats); err != nil {
+			return stats, err
+		}
+		pending, lastFound = pending[:0], found
+	}
+	if len(pending) > 0 {
+		// track the faces to the last frame
+		found, err := v.check(pending[len(pending)-1], &stats)
+		if err != nil {
+			return stats, err
+		}
+		if err := v.track(w, pending, lastFound, found, &stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// check finds the faces and objects in a keyframe.
+func (v *videoAnonymiser) check(frame *image.RGBA, stats *videoStats) (detections, error) {
+	stats.checked++
+	return v.server.checkFrame(frame)
+}
+
+// track redacts and writes frames, where b was found in the last frame,
+// and a in the frame before the first. The faces and objects in the
+// frames in between are interpolated, unless some can't be paired up;
+// then the frames in between are checked too.
+func (v *videoAnonymiser) track(w io.Writer, frames []*image.RGBA, a, b detections, stats *videoStats) error {
+	track := paired(a, b)
+	for i, frame := range frames {
+		found := b
+		if i < len(frames)-1 {
+			if track {
+				found = interpolate(a, b, float64(i+1)/float64(len(frames)))
+			} else {
+				var err error
+				if found, err = v.check(frame, stats); err != nil {
+					return err
+				}
+			}
+		}
+		for _, area := range v.opts.report(found, v.bounds).areas() {
+			v.opts.redact(frame, area)
+			stats.redacted++
+		}
+		n := stats.frames - len(frames) + i
+		for c := v.copies(n); c > 0; c-- {
+			if _, err := w.Write(frame.Pix); err != nil {
+				return errors.Wrap(err, "writing frames")
+			}
+		}
+		v.free = append(v.free, frame)
+		if v.progress != nil {
+			v.progress(n + 1)
+		}
+	}
+	return nil
+}
+
+// copies gets how many times to write frame n, so that at the constant
+// frame rate of the output it is shown at its time in the source. It is
+// 1 unless the frame rate varies, and 0 if the next frame takes its
+// place.
+func (v *videoAnonymiser) copies(n int) int {
+	if v.fps <= 0 || n+1 >= len(v.times) {
+		return 1
+	}
+	slot := func(t float64) int {
+		return int(math.Round((t - v.times[0]) * v.fps))
+	}
+	return slot(v.times[n+1]) - slot(v.times[n])
+}
+
+// frame gets a frame to read into, using an old one if there is one.
+func (v *videoAnonymiser) frame() *image.RGBA {
+	if n := len(v.free); n > 0 {
+		frame := v.free[n-1]
+		v.free = v.free[:n-1]
+		return frame
+	}
+	return image.NewRGBA(v.bounds)
+}
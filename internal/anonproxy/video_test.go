@@ -0,0 +1,103 @@
+package anonproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseProbe(t *testing.T) {
+	is := is.New(t)
+
+	info, err := parseProbe([]byte(`{
+		"packets": [{"pts_time": "0.000000"}, {"pts_time": "0.100000"}, {"pts_time": "0.033000"}],
+		"streams": [{"width": 64, "height": 48, "r_frame_rate": "30/1", "nb_frames": "3", "side_data_list": [{"rotation": -90}]}]
+	}`))
+	is.NoErr(err)
+	is.Equal(info.width, 48) // on its side
+	is.Equal(info.height, 64)
+	is.Equal(info.rate, "30/1")
+	is.Equal(info.fps, 30.0)
+	is.Equal(info.frames, 3)
+	is.Equal(info.times, []float64{0, 0.033, 0.1}) // in the order they're shown
+
+	_, err = parseProbe([]byte(`{"streams": [{"width": 64, "height": 48, "r_frame_rate": "0/0"}]}`))
+	is.True(err != nil)
+}
+
+func TestVideoCopies(t *testing.T) {
+	is := is.New(t)
+
+	// the third frame is late, and the fourth and fifth are in the
+	// same slot at 30fps
+	v := &videoAnonymiser{fps: 30, times: []float64{0, 0.033, 0.1, 0.133, 0.14}}
+	var copies []int
+	for n := 0; n < 6; n++ {
+		copies = append(copies, v.copies(n))
+	}
+	is.Equal(copies, []int{1, 2, 1, 0, 1, 1})
+
+	v = &videoAnonymiser{}
+	is.Equal(v.copies(0), 1) // no timestamps
+}
+
+// seqDetector finds the objects in seq, one entry per image checked.
+type seqDetector struct {
+	mu  sync.Mutex
+	seq [][]Object
+}
+
+func (d *seqDetector) Detect(b []byte) ([]Object, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.seq) == 0 {
+		return nil, nil
+	}
+	objects := d.seq[0]
+	d.seq = d.seq[1:]
+	return objects, nil
+}
+
+func TestVideoTracking(t *testing.T) {
+	is := is.New(t)
+	fb := newFakeFacebox()
+	defer fb.Close()
+	plate := func(x int) []Object {
+		return []Object{{Label: "plate", Confidence: 0.9, Rect: image.Rect(x, 4, x+8, 12)}}
+	}
+	// the plate jumps further than its width between keyframes 0 and
+	// 4, so frames 1 to 3 are checked, after frame 4
+	d := &seqDetector{seq: [][]Object{plate(0), plate(40), plate(10), plate(20), plate(30)}}
+	opts, err := params{defaults: map[string]string{"style": "solid", "labels": "plate"}}.options()
+	is.NoErr(err)
+	opts.keyframes = 4
+	bounds := image.Rect(0, 0, 48, 16)
+	v := &videoAnonymiser{
+		server: &server{fb: fb.client(), detectors: []Detector{d}},
+		opts:   opts,
+		bounds: bounds,
+	}
+	var in bytes.Buffer
+	for i := 0; i < 5; i++ {
+		frame := image.NewRGBA(bounds)
+		draw.Draw(frame, bounds, image.White, image.ZP, draw.Src)
+		in.Write(frame.Pix)
+	}
+	var out bytes.Buffer
+	stats, err := v.anonymise(&in, &out)
+	is.NoErr(err)
+	is.Equal(out.Len(), 5*4*bounds.Dx()*bounds.Dy())
+	is.Equal(stats.frames, 5)
+	is.Equal(stats.checked, 5)
+	is.Equal(fb.checked(), 5)
+	for i, x := range []int{0, 10, 20, 30, 40} {
+		size := 4 * bounds.Dx() * bounds.Dy()
+		frame := &image.RGBA{Pix: out.Bytes()[i*size : (i+1)*size], Stride: 4 * bounds.Dx(), Rect: bounds}
+		is.Equal(frame.RGBAAt(x+4, 8), color.RGBA{0, 0, 0, 0xff}) // the plate is redacted in every frame
+	}
+}
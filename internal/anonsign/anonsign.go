@@ -0,0 +1,99 @@
+// Package anonsign makes signed links to anonproxy.
+package anonsign
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/machinebox/toys/signedurl"
+	"github.com/pkg/errors"
+)
+
+// summary describes the command in help output.
+const summary = "Make signed anonproxy links for image URLs (given as arguments, or one per line on stdin)"
+
+// Command is the anonsign command.
+var Command = cli.Command{
+	Name:    "anonsign",
+	Summary: summary,
+	Run:     Run,
+}
+
+// Run writes a signed link for each image URL.
+func Run(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("anonsign", summary+".")
+	var (
+		secret  = flags.String("secret", "", "secret key that anonproxy checks signatures with")
+		proxy   = flags.String("proxy", "http://localhost:8000/", "anonproxy URL to link to, with any options in the query (e.g. http://localhost:8000/?style=blur)")
+		expires = flags.Duration("expires", 24*time.Hour, "how long links work for (0 for ever)")
+	)
+	if ok, err := config.Parse("anonsign", flags, args); !ok {
+		return err
+	}
+	if *secret == "" {
+		return errors.New("secret required")
+	}
+	if _, err := url.Parse(*proxy); err != nil {
+		return errors.Wrap(err, "proxy")
+	}
+	var expiry time.Time
+	if *expires > 0 {
+		expiry = time.Now().Add(*expires)
+	}
+	sign := func(src string) error {
+		link, err := link(*proxy, src, []byte(*secret), expiry)
+		if err != nil {
+			return errors.Wrap(err, src)
+		}
+		fmt.Println(link)
+		return nil
+	}
+	if flags.NArg() > 0 {
+		for _, src := range flags.Args() {
+			if err := sign(src); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return eachLine(ctx, os.Stdin, sign)
+}
+
+// link makes a signed link to the proxy for the image at src.
+func link(proxy, src string, secret []byte, expires time.Time) (string, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("src", src)
+	u.RawQuery = query.Encode()
+	return signedurl.Sign(http.MethodGet, u.String(), secret, expires)
+}
+
+// eachLine calls fn with each non-blank line read from r.
+func eachLine(ctx context.Context, r io.Reader, fn func(line string) error) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
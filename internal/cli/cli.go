@@ -0,0 +1,161 @@
+// Package cli is the plumbing shared by the toys, whether they run as
+// their own programs or as subcommands of the toys binary.
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/machinebox/sdk-go/boxutil"
+	"github.com/machinebox/sdk-go/classificationbox"
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/machinebox/sdk-go/objectbox"
+	"github.com/machinebox/sdk-go/videobox"
+	"github.com/pkg/errors"
+)
+
+// Command is a tool.
+type Command struct {
+	// Name is the name of the command.
+	Name string
+	// Summary is a one line description of the command.
+	Summary string
+	// Run runs the command with the arguments that follow its name.
+	Run func(ctx context.Context, args []string) error
+}
+
+// Program is the name of the running program, when it is not the
+// command itself.
+// It prefixes command names in usage output.
+var Program string
+
+// Main runs cmd as a program, and exits if it fails.
+func Main(cmd Command) {
+	Exec(cmd, os.Args[1:])
+}
+
+// Exec runs cmd with args, and exits if it fails.
+func Exec(cmd Command, args []string) {
+	ctx, cancel := Context()
+	defer cancel()
+	SetupLog(cmd.Name)
+	if err := cmd.Run(ctx, args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// SetupLog makes log output consistent across the commands.
+func SetupLog(name string) {
+	log.SetPrefix(name + ": ")
+	log.SetFlags(log.LstdFlags)
+}
+
+// Context gets a context that is cancelled when the program is
+// interrupted (Ctrl+C) or terminated.
+func Context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(c)
+	}()
+	return ctx, cancel
+}
+
+// FlagSet makes a flag set for a command, with usage output that
+// describes it.
+func FlagSet(name, summary string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		out := flags.Output()
+		usage := name
+		if Program != "" {
+			usage = Program + " " + name
+		}
+		fmt.Fprintf(out, "usage: %s [flags]\n", usage)
+		if summary != "" {
+			fmt.Fprintf(out, "\n%s\n", summary)
+		}
+		fmt.Fprintln(out, "\nflags:")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// PrintCommands writes a list of the commands to stderr.
+func PrintCommands(program string, commands []Command) {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nuse \"%s help <command>\" for more about a command.\n", program)
+}
+
+// WaitForBox checks that the box at addr is the one named, and waits for
+// it to be ready.
+func WaitForBox(ctx context.Context, name, addr string, box boxutil.Box) error {
+	info, err := box.Info()
+	if err != nil {
+		return errors.Wrap(err, "cannot find "+name)
+	}
+	if info.Name != strings.ToLower(name) {
+		return errors.New(name + " not running on " + addr + ". Go to https://machinebox.io/account to get started.")
+	}
+	if info.Status == "ready" {
+		return nil
+	}
+	log.Println("waiting for " + name + " to be ready...")
+	if err := boxutil.WaitForReady(ctx, box); err != nil {
+		return errors.Wrap(err, "waiting for "+name)
+	}
+	log.Println(name + " ready")
+	return nil
+}
+
+// Classificationbox connects to Classificationbox and waits for it to be
+// ready.
+func Classificationbox(ctx context.Context, addr string) (*classificationbox.Client, error) {
+	cb := classificationbox.New(addr)
+	if err := WaitForBox(ctx, "Classificationbox", addr, cb); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// Facebox connects to Facebox and waits for it to be ready.
+func Facebox(ctx context.Context, addr string) (*facebox.Client, error) {
+	fb := facebox.New(addr)
+	if err := WaitForBox(ctx, "Facebox", addr, fb); err != nil {
+		return nil, err
+	}
+	return fb, nil
+}
+
+// Objectbox connects to Objectbox and waits for it to be ready.
+func Objectbox(ctx context.Context, addr string) (*objectbox.Client, error) {
+	ob := objectbox.New(addr)
+	if err := WaitForBox(ctx, "Objectbox", addr, ob); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// Videobox connects to Videobox and waits for it to be ready.
+func Videobox(ctx context.Context, addr string) (*videobox.Client, error) {
+	vb := videobox.New(addr)
+	if err := WaitForBox(ctx, "Videobox", addr, vb); err != nil {
+		return nil, err
+	}
+	return vb, nil
+}
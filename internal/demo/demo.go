@@ -0,0 +1,46 @@
+// Package demo serves the static web demos.
+package demo
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+)
+
+// summary describes the command in help output.
+const summary = "Serve a web demo (celebmatch, suggestpage or faceverify)"
+
+// Command is the serve-demo command.
+var Command = cli.Command{
+	Name:    "serve-demo",
+	Summary: summary,
+	Run:     Run,
+}
+
+// Run serves the files in the public directory.
+func Run(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("serve-demo", summary+".")
+	var (
+		addr = flags.String("addr", ":9000", "listen address")
+		dir  = flags.String("dir", "public", "directory of files to serve")
+	)
+	if ok, err := config.Parse("serve-demo", flags, args); !ok {
+		return err
+	}
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: http.FileServer(http.Dir(*dir)),
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Println("listening on", *addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Package evaluate is the part of the imgclass and textclass tools that
+// doesn't care what is being classified: comparing the predictions of
+// two models, and describing datasets.
+package evaluate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Comparison is the prediction of each model for an example. Old or New
+// is empty if that model couldn't predict it, which counts as a wrong
+// answer.
+type Comparison struct {
+	Path     string
+	Expected string
+	Old      string
+	New      string
+}
+
+// Metrics describe how well a model did.
+type Metrics struct {
+	Accuracy  float64
+	MacroF1   float64
+	Classes   []string
+	Precision map[string]float64
+	Recall    map[string]float64
+}
+
+// Compare prints the metrics of the old and new models, the examples
+// they disagree on and McNemar's test, and returns an error if the
+// accuracy of the new model is more than tolerance below the old one.
+// Examples a model couldn't predict count against it, so a model that
+// fails on many of them can't pass on the few it managed.
+func Compare(results []Comparison, tolerance float64) error {
+	if len(results) == 0 {
+		return errors.New("no examples to compare")
+	}
+	var oldErrs, newErrs int
+	for _, result := range results {
+		if result.Old == "" {
+			oldErrs++
+		}
+		if result.New == "" {
+			newErrs++
+		}
+	}
+	oldMetrics := ComputeMetrics(results, func(c Comparison) string { return c.Old })
+	newMetrics := ComputeMetrics(results, func(c Comparison) string { return c.New })
+	fmt.Println()
+	fmt.Printf("Examples:   %d\n", len(results))
+	fmt.Printf("Errors:     %d old, %d new\n", oldErrs, newErrs)
+	fmt.Println()
+	fmt.Printf("%-20s %10s %10s %10s\n", "", "old", "new", "delta")
+	printMetric := func(name string, before, after float64) {
+		fmt.Printf("%-20s %9.2f%% %9.2f%% %+9.2f%%\n", name, before*100, after*100, (after-before)*100)
+	}
+	printMetric("Accuracy", oldMetrics.Accuracy, newMetrics.Accuracy)
+	printMetric("Macro F1", oldMetrics.MacroF1, newMetrics.MacroF1)
+	for _, class := range oldMetrics.Classes {
+		printMetric(class+" precision", oldMetrics.Precision[class], newMetrics.Precision[class])
+		printMetric(class+" recall", oldMetrics.Recall[class], newMetrics.Recall[class])
+	}
+	fmt.Println()
+	var oldOnly, newOnly int
+	var disagreements []Comparison
+	for _, result := range results {
+		oldCorrect, newCorrect := result.Old == result.Expected, result.New == result.Expected
+		switch {
+		case oldCorrect && !newCorrect:
+			oldOnly++
+		case !oldCorrect && newCorrect:
+			newOnly++
+		}
+		if result.Old != result.New {
+			disagreements = append(disagreements, result)
+		}
+	}
+	if len(disagreements) > 0 {
+		fmt.Println("Disagreements")
+		fmt.Println("-------------")
+		for _, d := range disagreements {
+			var note string
+			switch d.Expected {
+			case d.Old:
+				note = "\tREGRESSION"
+			case d.New:
+				note = "\tfixed"
+			}
+			fmt.Printf("%s:\texpected %s, old %s, new %s%s\n", d.Path, d.Expected, predicted(d.Old), predicted(d.New), note)
+		}
+		fmt.Println()
+	}
+	p := McNemar(oldOnly, newOnly)
+	fmt.Println("McNemar's test")
+	fmt.Println("--------------")
+	fmt.Printf("Old right, new wrong:  %d\n", oldOnly)
+	fmt.Printf("Old wrong, new right:  %d\n", newOnly)
+	fmt.Printf("p-value:               %.4f", p)
+	if p < 0.05 {
+		fmt.Print("\t(significant at 0.05)")
+	} else {
+		fmt.Print("\t(not significant at 0.05)")
+	}
+	fmt.Println()
+	fmt.Println()
+	if newErrs == len(results) {
+		return errors.New("the new model couldn't predict any examples")
+	}
+	if drop := oldMetrics.Accuracy - newMetrics.Accuracy; drop > tolerance {
+		return errors.Errorf("new model regressed: accuracy down %.2f%% (tolerance %.2f%%)", drop*100, tolerance*100)
+	}
+	return nil
+}
+
+// predicted describes a prediction in the list of disagreements.
+func predicted(class string) string {
+	if class == "" {
+		return "(error)"
+	}
+	return class
+}
+
+// ComputeMetrics works out the metrics for the predictions picked out
+// of each comparison.
+func ComputeMetrics(results []Comparison, predicted func(Comparison) string) Metrics {
+	m := Metrics{
+		Precision: make(map[string]float64),
+		Recall:    make(map[string]float64),
+	}
+	truePositives := make(map[string]int)
+	predictedCount := make(map[string]int)
+	expectedCount := make(map[string]int)
+	var correct int
+	for _, result := range results {
+		prediction := predicted(result)
+		expectedCount[result.Expected]++
+		predictedCount[prediction]++
+		if prediction == result.Expected {
+			correct++
+			truePositives[prediction]++
+		}
+	}
+	if len(results) > 0 {
+		m.Accuracy = float64(correct) / float64(len(results))
+	}
+	for class := range expectedCount {
+		m.Classes = append(m.Classes, class)
+	}
+	sort.Strings(m.Classes)
+	for _, class := range m.Classes {
+		if predictedCount[class] > 0 {
+			m.Precision[class] = float64(truePositives[class]) / float64(predictedCount[class])
+		}
+		m.Recall[class] = float64(truePositives[class]) / float64(expectedCount[class])
+		if p, r := m.Precision[class], m.Recall[class]; p+r > 0 {
+			m.MacroF1 += 2 * p * r / (p + r)
+		}
+	}
+	if len(m.Classes) > 0 {
+		m.MacroF1 /= float64(len(m.Classes))
+	}
+	return m
+}
+
+// McNemar gets the two-sided p-value of McNemar's test, where b and c
+// are the number of examples only one of the models got right.
+// Small samples use the exact binomial test, otherwise the chi-squared
+// approximation with continuity correction is used.
+func McNemar(b, c int) float64 {
+	n := b + c
+	if n == 0 {
+		return 1
+	}
+	if n < 25 {
+		k := b
+		if c < k {
+			k = c
+		}
+		var p float64
+		for i := 0; i <= k; i++ {
+			p += binomial(n, i) * math.Pow(0.5, float64(n))
+		}
+		return math.Min(1, 2*p)
+	}
+	diff := math.Abs(float64(b-c)) - 1
+	chi2 := diff * diff / float64(n)
+	// survival function of the chi-squared distribution with one
+	// degree of freedom
+	return math.Erfc(math.Sqrt(chi2 / 2))
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result *= float64(n-k+i) / float64(i)
+	}
+	return result
+}
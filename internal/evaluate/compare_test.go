@@ -0,0 +1,63 @@
+package evaluate
+
+import (
+	"math"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestMcNemar(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(McNemar(0, 0), 1.0)
+	is.Equal(McNemar(3, 3), 1.0)
+	// exact binomial: 2 * P(X <= 1) for n=10
+	is.True(math.Abs(McNemar(1, 9)-0.021484375) < 1e-9)
+	// chi-squared: (|10-30|-1)^2/40 = 9.025
+	is.True(math.Abs(McNemar(10, 30)-0.002663) < 1e-5)
+	is.Equal(McNemar(10, 30), McNemar(30, 10))
+}
+
+func TestComputeMetrics(t *testing.T) {
+	is := is.New(t)
+
+	results := []Comparison{
+		{Expected: "cats", Old: "cats", New: "cats"},
+		{Expected: "cats", Old: "dogs", New: "cats"},
+		{Expected: "dogs", Old: "dogs", New: "cats"},
+		{Expected: "dogs", Old: "dogs", New: "dogs"},
+	}
+	old := ComputeMetrics(results, func(c Comparison) string { return c.Old })
+	is.Equal(old.Accuracy, 0.75)
+	is.Equal(old.Classes, []string{"cats", "dogs"})
+	is.Equal(old.Precision["cats"], 1.0)
+	is.Equal(old.Recall["cats"], 0.5)
+	is.Equal(old.Recall["dogs"], 1.0)
+	newer := ComputeMetrics(results, func(c Comparison) string { return c.New })
+	is.Equal(newer.Accuracy, 0.75)
+	is.Equal(newer.Recall["cats"], 1.0)
+	is.Equal(newer.Recall["dogs"], 0.5)
+}
+
+func TestCompare(t *testing.T) {
+	is := is.New(t)
+
+	results := []Comparison{
+		{Expected: "cats", Old: "cats", New: "dogs"},
+		{Expected: "dogs", Old: "dogs", New: "dogs"},
+	}
+	is.True(Compare(results, 0.01) != nil) // accuracy down 50%
+	is.NoErr(Compare(results, 0.5))
+	is.True(Compare(nil, 0.5) != nil) // nothing to compare
+
+	// the new model only predicts one example, and gets it right
+	results = []Comparison{
+		{Expected: "cats", Old: "cats", New: "cats"},
+		{Expected: "dogs", Old: "dogs", New: ""},
+		{Expected: "dogs", Old: "dogs", New: ""},
+		{Expected: "cats", Old: "", New: ""},
+	}
+	is.True(Compare(results, 0.01) != nil) // errors count as wrong answers
+	is.True(Compare([]Comparison{{Expected: "cats", Old: "", New: ""}}, 1) != nil)
+}
@@ -0,0 +1,24 @@
+package evaluate
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Summarise describes the distribution of values.
+func Summarise(values []int) string {
+	if len(values) == 0 {
+		return "n/a"
+	}
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	var total int
+	for _, v := range sorted {
+		total += v
+	}
+	percentile := func(p int) int {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return fmt.Sprintf("min %d  p10 %d  median %d  p90 %d  max %d  mean %d",
+		sorted[0], percentile(10), percentile(50), percentile(90), sorted[len(sorted)-1], total/len(sorted))
+}
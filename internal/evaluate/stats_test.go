@@ -0,0 +1,14 @@
+package evaluate
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestSummarise(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(Summarise(nil), "n/a")
+	is.Equal(Summarise([]int{5, 1, 3}), "min 1  p10 1  median 3  p90 3  max 5  mean 3")
+}
@@ -0,0 +1,103 @@
+package imdbteach
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/machinebox/sdk-go/facebox"
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// summary describes the command in help output.
+const summary = "Teach Facebox the faces in the IMDB dataset"
+
+// Command is the imdbteach command.
+var Command = cli.Command{
+	Name:    "imdbteach",
+	Summary: summary,
+	Run:     Run,
+}
+
+// Run teaches Facebox every face listed in the names file.
+func Run(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("imdbteach", summary+".")
+	var (
+		faceboxAddr = flags.String("facebox", "http://localhost:8080", "Facebox address")
+		names       = flags.String("names", "namesandpaths.txt", "file of name,path lines to teach")
+		images      = flags.String("images", "imdb_crop", "directory the paths in the names file are relative to")
+		workers     = flags.Int("workers", 4, "number of images to teach at once")
+	)
+	if ok, err := config.Parse("imdbteach", flags, args); !ok {
+		return err
+	}
+	if *workers < 1 {
+		return errors.New("workers must be at least 1")
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	faceboxClient, err := cli.Facebox(waitCtx, *faceboxAddr)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(*names)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	type Item struct {
+		Filename, Celebname string
+	}
+	itemsChan := make(chan Item)
+	defer close(itemsChan)
+	for i := 0; i < *workers; i++ {
+		go func() {
+			for item := range itemsChan {
+				err := teachFromFile(faceboxClient, item.Filename, item.Celebname)
+				if err != nil {
+					//log.Println("ERROR: teachFromFile:", err)
+				}
+			}
+		}()
+	}
+
+	bar := pb.StartNew(460723)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		//log.Println(s.Text())
+		subs := strings.Split(s.Text(), ",")
+		celebname := subs[0]
+		filename := filepath.Join(*images, subs[1])
+		itemsChan <- Item{
+			Filename:  filename,
+			Celebname: celebname,
+		}
+		bar.Increment()
+	}
+	bar.Finish()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func teachFromFile(faceboxClient *facebox.Client, filename, name string) error {
+	//log.Printf("Now teaching %v (%v)\n", filename, name)
+	r, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	err = faceboxClient.Teach(r, filename, name)
+	if err != nil {
+		return err
+	}
+	return nil
+}
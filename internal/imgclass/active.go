@@ -0,0 +1,534 @@
+package imgclass
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/machinebox/sdk-go/classificationbox"
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// runActive runs the active learning loop; it predicts over a pool
+// of unlabeled images, asks for labels for the ones the model is
+// least sure about, teaches them, and repeats.
+func runActive(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("imgclass active", "Improve a model by labeling the images it is least sure about.")
+	var (
+		cbAddr   = flags.String("cb", "http://localhost:8080", "Classificationbox address")
+		modelID  = flags.String("model", "", "ID of the model to improve")
+		pool     = flags.String("pool", ".", "directory of unlabeled images")
+		n        = flags.Int("n", 10, "number of images to label each round")
+		strategy = flags.String("strategy", "margin", "uncertainty measure (margin or entropy)")
+		rounds   = flags.Int("rounds", 0, "number of rounds (0 keeps going until the pool is empty)")
+		dest     = flags.String("dest", "", "copy labeled images into this dataset directory (optional)")
+		uiAddr   = flags.String("ui", "", "label in the browser at this address instead of the terminal (e.g. localhost:9000)")
+	)
+	if ok, err := config.Parse("imgclass", flags, args); !ok {
+		return err
+	}
+	if *modelID == "" {
+		return errors.New("-model is required")
+	}
+	if *n < 1 {
+		return errors.New("-n must be at least 1")
+	}
+	measure, err := uncertaintyMeasure(*strategy)
+	if err != nil {
+		return err
+	}
+	cb, err := cli.Classificationbox(ctx, *cbAddr)
+	if err != nil {
+		return err
+	}
+	model, err := cb.GetModel(ctx, *modelID)
+	if err != nil {
+		return errors.Wrap(err, "get model")
+	}
+	if len(model.Classes) < 2 {
+		return errors.New("model needs at least two classes")
+	}
+	paths, err := collectPool(*pool)
+	if err != nil {
+		return errors.Wrap(err, "pool")
+	}
+	var labeler labeler = terminalLabeler{}
+	if *uiAddr != "" {
+		web := newWebLabeler(*uiAddr)
+		srv := &http.Server{Addr: *uiAddr, Handler: web}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Println("web ui:", err)
+			}
+		}()
+		defer srv.Close()
+		labeler = web
+	}
+	seen := make(map[string]bool)
+	for round := 1; *rounds == 0 || round <= *rounds; round++ {
+		var remaining []string
+		for _, path := range paths {
+			if !seen[path] {
+				remaining = append(remaining, path)
+			}
+		}
+		if len(remaining) == 0 {
+			fmt.Println("no unlabeled images left in the pool")
+			break
+		}
+		fmt.Printf("round %d: predicting %d unlabeled image(s)...\n", round, len(remaining))
+		candidates, failed, err := rankPool(ctx, cb, model, remaining, measure)
+		if err != nil {
+			return errors.Wrap(err, "ranking")
+		}
+		// images that can't be predicted won't be next time either
+		for _, path := range failed {
+			seen[path] = true
+		}
+		if len(candidates) == 0 {
+			fmt.Println("none of the images left in the pool could be predicted")
+			break
+		}
+		if len(candidates) > *n {
+			candidates = candidates[:*n]
+		}
+		labeled, quit, err := labeler.label(ctx, model.Classes, candidates)
+		if err != nil {
+			return errors.Wrap(err, "labeling")
+		}
+		// labeled and skipped images are not offered again
+		for _, c := range candidates {
+			seen[c.path] = true
+		}
+		if len(labeled) > 0 {
+			if err := teach(ctx, cb, model.ID, labeled); err != nil {
+				return errors.Wrap(err, "teaching")
+			}
+			if *dest != "" {
+				for _, image := range labeled {
+					if err := copyToDataset(*dest, *pool, image); err != nil {
+						return errors.Wrap(err, "copy to dataset")
+					}
+				}
+			}
+		}
+		fmt.Printf("round %d: %d image(s) labeled, %d skipped\n", round, len(labeled), len(candidates)-len(labeled))
+		if quit {
+			break
+		}
+	}
+	return nil
+}
+
+// candidate is an unlabeled image along with what the model
+// currently thinks of it.
+type candidate struct {
+	path        string
+	classes     []classScore
+	uncertainty float64
+}
+
+type classScore struct {
+	ID    string
+	Score float64
+}
+
+// rankPool predicts every image in the pool and returns them with the
+// most uncertain first, along with the paths of images that couldn't be
+// predicted.
+func rankPool(ctx context.Context, cb *classificationbox.Client, model classificationbox.Model, paths []string, measure func([]float64) float64) ([]candidate, []string, error) {
+	bar := pb.StartNew(len(paths))
+	var candidates []candidate
+	var failed []string
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		classes, err := predictScores(ctx, cb, model.ID, path, len(model.Classes))
+		bar.Increment()
+		if err != nil {
+			failed = append(failed, path)
+			continue
+		}
+		scores := make([]float64, len(classes))
+		for i := range classes {
+			scores[i] = classes[i].Score
+		}
+		candidates = append(candidates, candidate{
+			path:        path,
+			classes:     classes,
+			uncertainty: measure(scores),
+		})
+	}
+	bar.FinishPrint("Prediction complete")
+	if len(failed) > 0 {
+		fmt.Printf("%d image(s) could not be predicted and were left out\n", len(failed))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].uncertainty > candidates[j].uncertainty
+	})
+	return candidates, failed, nil
+}
+
+func predictScores(ctx context.Context, cb *classificationbox.Client, modelID, path string, limit int) ([]classScore, error) {
+	base64, err := base64Image(path)
+	if err != nil {
+		return nil, err
+	}
+	req := classificationbox.PredictRequest{
+		Limit: limit,
+		Inputs: []classificationbox.Feature{
+			classificationbox.FeatureImageBase64("image", base64),
+		},
+	}
+	resp, err := cb.Predict(ctx, modelID, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "predict")
+	}
+	if len(resp.Classes) == 0 {
+		return nil, errors.New("predict: no classes")
+	}
+	classes := make([]classScore, len(resp.Classes))
+	for i, class := range resp.Classes {
+		classes[i] = classScore{ID: class.ID, Score: class.Score}
+	}
+	return classes, nil
+}
+
+// uncertaintyMeasure gets the function for the named strategy.
+// Measures return a value between 0 (sure) and 1 (no idea).
+func uncertaintyMeasure(strategy string) (func([]float64) float64, error) {
+	switch strategy {
+	case "margin":
+		return marginUncertainty, nil
+	case "entropy":
+		return entropyUncertainty, nil
+	}
+	return nil, errors.New("unknown strategy: " + strategy)
+}
+
+// marginUncertainty is high when the top two scores are close.
+func marginUncertainty(scores []float64) float64 {
+	if len(scores) < 2 {
+		return 0
+	}
+	sorted := append([]float64(nil), scores...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	return 1 - (sorted[0] - sorted[1])
+}
+
+// entropyUncertainty is the normalised entropy of the scores, so it is
+// high when the scores are spread evenly across the classes.
+func entropyUncertainty(scores []float64) float64 {
+	if len(scores) < 2 {
+		return 0
+	}
+	var total float64
+	for _, score := range scores {
+		total += score
+	}
+	if total <= 0 {
+		return 1
+	}
+	var entropy float64
+	for _, score := range scores {
+		p := score / total
+		if p > 0 {
+			entropy -= p * math.Log(p)
+		}
+	}
+	return entropy / math.Log(float64(len(scores)))
+}
+
+// imageExtensions are the extensions of the files in the pool that are
+// treated as images.
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// collectPool finds the unlabeled images in dir.
+func collectPool(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && skip(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// copyToDataset copies a labeled image from the pool into the class
+// directory of the dataset at dest. Files already in the dataset are
+// never overwritten; the copy gets a number after its name instead.
+func copyToDataset(dest, pool string, image imageExample) error {
+	dir := filepath.Join(dest, image.class)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	src, err := os.Open(image.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	name := datasetName(pool, image.path)
+	ext := filepath.Ext(name)
+	path := filepath.Join(dir, name)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	for n := 2; os.IsExist(err); n++ {
+		path = filepath.Join(dir, strings.TrimSuffix(name, ext)+"-"+strconv.Itoa(n)+ext)
+		dst, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// datasetName gets the file name for a pool image in the dataset. Images
+// in subdirectories of the pool are prefixed with the directories, so
+// a/cat.jpg and b/cat.jpg don't overwrite each other.
+func datasetName(pool, path string) string {
+	rel, err := filepath.Rel(pool, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.Base(path)
+	}
+	return strings.Replace(filepath.ToSlash(rel), "/", "_", -1)
+}
+
+// labeler gets a human to label candidates.
+type labeler interface {
+	// label returns the candidates that were given a class, and
+	// whether the user has had enough.
+	label(ctx context.Context, classes []string, candidates []candidate) (labeled []imageExample, quit bool, err error)
+}
+
+// terminalLabeler asks for labels on stdin.
+type terminalLabeler struct{}
+
+func (terminalLabeler) label(ctx context.Context, classes []string, candidates []candidate) ([]imageExample, bool, error) {
+	fmt.Println()
+	var choices []string
+	for i, class := range classes {
+		choices = append(choices, fmt.Sprintf("%d) %s", i+1, class))
+	}
+	var labeled []imageExample
+	s := bufio.NewScanner(os.Stdin)
+	for i, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		fmt.Printf("[%d/%d] %s (uncertainty %.2f)\n", i+1, len(candidates), c.path, c.uncertainty)
+		var guesses []string
+		for _, class := range c.classes {
+			guesses = append(guesses, fmt.Sprintf("%s %.2f", class.ID, class.Score))
+		}
+		fmt.Println("  model thinks:", strings.Join(guesses, ", "))
+		fmt.Println("  " + strings.Join(choices, "  "))
+		prompt := "  class (number or name, blank to skip, q to quit): "
+		fmt.Print(prompt)
+		for s.Scan() {
+			answer := strings.TrimSpace(s.Text())
+			if answer == "" {
+				break
+			}
+			if strings.ToLower(answer) == "q" {
+				return labeled, true, nil
+			}
+			if class, ok := matchClass(classes, answer); ok {
+				labeled = append(labeled, imageExample{path: c.path, class: class})
+				break
+			}
+			fmt.Print(prompt)
+		}
+		if err := s.Err(); err != nil {
+			return nil, false, err
+		}
+	}
+	fmt.Println()
+	return labeled, false, nil
+}
+
+// matchClass finds the class by its 1-based number or its name.
+func matchClass(classes []string, answer string) (string, bool) {
+	if i, err := strconv.Atoi(answer); err == nil {
+		if i < 1 || i > len(classes) {
+			return "", false
+		}
+		return classes[i-1], true
+	}
+	for _, class := range classes {
+		if strings.EqualFold(class, answer) {
+			return class, true
+		}
+	}
+	return "", false
+}
+
+// webLabeler serves a page showing the candidates with a class picker
+// for each.
+type webLabeler struct {
+	addr    string
+	results chan webResult
+
+	mu      sync.Mutex
+	classes []string
+	batch   []candidate
+}
+
+type webResult struct {
+	labeled []imageExample
+	quit    bool
+}
+
+func newWebLabeler(addr string) *webLabeler {
+	return &webLabeler{
+		addr:    addr,
+		results: make(chan webResult),
+	}
+}
+
+func (l *webLabeler) label(ctx context.Context, classes []string, candidates []candidate) ([]imageExample, bool, error) {
+	l.mu.Lock()
+	l.classes = classes
+	l.batch = candidates
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.batch = nil
+		l.mu.Unlock()
+	}()
+	fmt.Printf("label %d image(s) at http://%s/\n", len(candidates), l.addr)
+	select {
+	case result := <-l.results:
+		return result.labeled, result.quit, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+func (l *webLabeler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	classes, batch := l.classes, l.batch
+	l.mu.Unlock()
+	switch {
+	case r.URL.Path == "/image":
+		i, err := strconv.Atoi(r.URL.Query().Get("i"))
+		if err != nil || i < 0 || i >= len(batch) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, batch[i].path)
+	case r.URL.Path != "/":
+		http.NotFound(w, r)
+	case r.Method == http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var result webResult
+		for i, c := range batch {
+			if class, ok := matchClass(classes, r.Form.Get("label"+strconv.Itoa(i))); ok {
+				result.labeled = append(result.labeled, imageExample{path: c.path, class: class})
+			}
+		}
+		result.quit = r.Form.Get("quit") != ""
+		select {
+		case l.results <- result:
+		case <-time.After(5 * time.Second):
+			http.Error(w, "not waiting for labels, reload and try again", http.StatusConflict)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		data := struct {
+			Classes []string
+			Batch   []string
+		}{
+			Classes: classes,
+		}
+		for _, c := range batch {
+			var guesses []string
+			for _, class := range c.classes {
+				guesses = append(guesses, fmt.Sprintf("%s %.2f", class.ID, class.Score))
+			}
+			data.Batch = append(data.Batch, strings.Join(guesses, ", "))
+		}
+		if err := labelTemplate.Execute(w, data); err != nil {
+			log.Println("web ui:", err)
+		}
+	}
+}
+
+var labelTemplate = template.Must(template.New("label").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>imgclass active learning</title>
+	{{ if not .Batch }}<meta http-equiv="refresh" content="2">{{ end }}
+	<style>
+		body { font-family: sans-serif; }
+		.item { display: inline-block; margin: 10px; vertical-align: top; width: 240px; }
+		.item img { max-width: 240px; max-height: 240px; }
+		.item small { display: block; color: #666; }
+	</style>
+</head>
+<body>
+	{{ if .Batch }}
+	<form method="post">
+		{{ range $i, $guesses := .Batch }}
+		<div class="item">
+			<img src="/image?i={{ $i }}">
+			<small>{{ $guesses }}</small>
+			<select name="label{{ $i }}">
+				<option value="">(skip)</option>
+				{{ range $j, $class := $.Classes }}<option value="{{ inc $j }}">{{ $class }}</option>{{ end }}
+			</select>
+		</div>
+		{{ end }}
+		<p>
+			<button type="submit">Teach</button>
+			<button type="submit" name="quit" value="1">Teach and finish</button>
+		</p>
+	</form>
+	{{ else }}
+	<p>Waiting for the next batch...</p>
+	{{ end }}
+</body>
+</html>
+`))
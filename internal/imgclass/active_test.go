@@ -0,0 +1,94 @@
+package imgclass
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestUncertainty(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(marginUncertainty([]float64{0.5, 0.5}), 1.0)
+	is.Equal(marginUncertainty([]float64{0.25, 0.75}), 0.5)
+	is.True(marginUncertainty([]float64{0.6, 0.4}) > marginUncertainty([]float64{0.9, 0.1}))
+
+	is.True(math.Abs(entropyUncertainty([]float64{0.25, 0.25, 0.25, 0.25})-1) < 1e-9)
+	is.Equal(entropyUncertainty([]float64{1, 0, 0}), 0.0)
+	is.True(entropyUncertainty([]float64{0.5, 0.5, 0}) > entropyUncertainty([]float64{0.9, 0.05, 0.05}))
+
+	_, err := uncertaintyMeasure("nope")
+	is.True(err != nil)
+}
+
+func TestMatchClass(t *testing.T) {
+	is := is.New(t)
+	classes := []string{"cats", "dogs"}
+
+	class, ok := matchClass(classes, "2")
+	is.True(ok)
+	is.Equal(class, "dogs")
+	class, ok = matchClass(classes, "Cats")
+	is.True(ok)
+	is.Equal(class, "cats")
+	_, ok = matchClass(classes, "3")
+	is.True(!ok)
+	_, ok = matchClass(classes, "birds")
+	is.True(!ok)
+}
+
+func TestDatasetName(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(datasetName("pool", filepath.Join("pool", "cat.jpg")), "cat.jpg")
+	is.Equal(datasetName("pool", filepath.Join("pool", "a", "cat.jpg")), "a_cat.jpg")
+	is.Equal(datasetName("pool", filepath.Join("pool", "b", "c", "cat.jpg")), "b_c_cat.jpg")
+
+	dir, err := ioutil.TempDir("", "imgclass")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	pool, dest := filepath.Join(dir, "pool"), filepath.Join(dir, "dataset")
+	for _, sub := range []string{"a", "b"} {
+		is.NoErr(os.MkdirAll(filepath.Join(pool, sub), 0755))
+		path := filepath.Join(pool, sub, "cat.jpg")
+		is.NoErr(ioutil.WriteFile(path, []byte(sub), 0644))
+		is.NoErr(copyToDataset(dest, pool, imageExample{path: path, class: "cats"}))
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dest, "cats", "a_cat.jpg"))
+	is.NoErr(err)
+	is.Equal(string(b), "a")
+	b, err = ioutil.ReadFile(filepath.Join(dest, "cats", "b_cat.jpg"))
+	is.NoErr(err)
+	is.Equal(string(b), "b")
+
+	// files already in the dataset are kept
+	path := filepath.Join(pool, "a", "cat.jpg")
+	is.NoErr(ioutil.WriteFile(path, []byte("again"), 0644))
+	is.NoErr(copyToDataset(dest, pool, imageExample{path: path, class: "cats"}))
+	b, err = ioutil.ReadFile(filepath.Join(dest, "cats", "a_cat.jpg"))
+	is.NoErr(err)
+	is.Equal(string(b), "a")
+	b, err = ioutil.ReadFile(filepath.Join(dest, "cats", "a_cat-2.jpg"))
+	is.NoErr(err)
+	is.Equal(string(b), "again")
+}
+
+func TestCollectPool(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "imgclass")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	is.NoErr(os.MkdirAll(filepath.Join(dir, "a"), 0755))
+	for _, name := range []string{"cat.jpg", "dog.PNG", "notes.txt", ".hidden.jpg", filepath.Join("a", "bird.gif"), filepath.Join("a", "Thumbs.db")} {
+		is.NoErr(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	paths, err := collectPool(dir)
+	is.NoErr(err)
+	is.Equal(paths, []string{filepath.Join(dir, "a", "bird.gif"), filepath.Join(dir, "cat.jpg"), filepath.Join(dir, "dog.PNG")})
+}
@@ -0,0 +1,87 @@
+package imgclass
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/machinebox/toys/internal/evaluate"
+	"github.com/pkg/errors"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// runCompare runs a validation set through two models and fails if the
+// new one is worse than the old one.
+func runCompare(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("imgclass compare", "Run a validation set through two models and fail if the new one is worse.")
+	var (
+		cbAddr    = flags.String("cb", "http://localhost:8080", "Classificationbox address of the old model")
+		newCBAddr = flags.String("newcb", "", "Classificationbox address of the new model (default is -cb)")
+		oldModel  = flags.String("old", "", "ID of the old model")
+		newModel  = flags.String("new", "", "ID of the new model (default is -old, to compare two boxes)")
+		src       = flags.String("src", ".", "source of validation dataset")
+		tolerance = flags.Float64("tolerance", 0.01, "largest drop in accuracy allowed before failing (0.01 is one percentage point)")
+	)
+	if ok, err := config.Parse("imgclass", flags, args); !ok {
+		return err
+	}
+	if *oldModel == "" {
+		return errors.New("-old is required")
+	}
+	if *newModel == "" {
+		*newModel = *oldModel
+	}
+	if *newCBAddr == "" {
+		*newCBAddr = *cbAddr
+	}
+	if *newModel == *oldModel && *newCBAddr == *cbAddr {
+		return errors.New("nothing to compare, specify -new or -newcb")
+	}
+	oldCB, err := cli.Classificationbox(ctx, *cbAddr)
+	if err != nil {
+		return err
+	}
+	newCB := oldCB
+	if *newCBAddr != *cbAddr {
+		newCB, err = cli.Classificationbox(ctx, *newCBAddr)
+		if err != nil {
+			return err
+		}
+	}
+	classes, err := collectTrainingData(ctx, *src)
+	if err != nil {
+		return errors.Wrap(err, "classes data")
+	}
+	images := newImageExamples(classes)
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].path < images[j].path
+	})
+	fmt.Print("comparing...")
+	bar := pb.StartNew(len(images))
+	var results []evaluate.Comparison
+	for _, image := range images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// a model that can't predict the example gets it wrong
+		oldClass, err := predictImage(ctx, oldCB, *oldModel, image)
+		if err != nil {
+			oldClass = ""
+		}
+		newClass, err := predictImage(ctx, newCB, *newModel, image)
+		if err != nil {
+			newClass = ""
+		}
+		results = append(results, evaluate.Comparison{
+			Path:     image.path,
+			Expected: image.class,
+			Old:      oldClass,
+			New:      newClass,
+		})
+		bar.Increment()
+	}
+	bar.FinishPrint("Comparison complete")
+	return evaluate.Compare(results, *tolerance)
+}
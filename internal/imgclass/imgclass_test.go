@@ -1,4 +1,4 @@
-package main
+package imgclass
 
 import (
 	"context"
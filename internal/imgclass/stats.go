@@ -0,0 +1,175 @@
+package imgclass
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	// formats supported by Classificationbox
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/machinebox/toys/internal/evaluate"
+	"github.com/pkg/errors"
+)
+
+// runStats reports on the dataset without talking to Classificationbox.
+// It returns an error if any files would fail to teach.
+func runStats(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("imgclass stats", "Report on the dataset without talking to Classificationbox.")
+	var (
+		src = flags.String("src", ".", "source of dataset")
+	)
+	if ok, err := config.Parse("imgclass", flags, args); !ok {
+		return err
+	}
+	stats, err := collectStats(ctx, *src)
+	if err != nil {
+		return errors.Wrap(err, "stats")
+	}
+	stats.print()
+	if problems := len(stats.empty) + len(stats.corrupt); problems > 0 {
+		return errors.Errorf("%d problem file(s) in dataset", problems)
+	}
+	if len(stats.classes) < 2 {
+		return errors.New("you need at least two classes")
+	}
+	return nil
+}
+
+// datasetStats describes the images in a dataset.
+type datasetStats struct {
+	classes map[string]int
+	sizes   []int
+	widths  []int
+	heights []int
+	formats map[string]int
+	// hidden are the files and folders skipped by skip.
+	hidden []string
+	// empty are zero byte files.
+	empty []string
+	// corrupt are the files that could not be decoded.
+	corrupt map[string]error
+}
+
+func collectStats(ctx context.Context, src string) (*datasetStats, error) {
+	stats := &datasetStats{
+		classes: make(map[string]int),
+		formats: make(map[string]int),
+		corrupt: make(map[string]error),
+	}
+	classdirs, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range classdirs {
+		if skip(dir.Name()) {
+			stats.hidden = append(stats.hidden, filepath.Join(src, dir.Name()))
+			continue
+		}
+		if !dir.IsDir() {
+			continue
+		}
+		imagefiles, err := ioutil.ReadDir(filepath.Join(src, dir.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, dir.Name())
+		}
+		for _, imageFile := range imagefiles {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			path := filepath.Join(src, dir.Name(), imageFile.Name())
+			if skip(imageFile.Name()) {
+				stats.hidden = append(stats.hidden, path)
+				continue
+			}
+			if imageFile.IsDir() {
+				continue
+			}
+			stats.classes[dir.Name()]++
+			stats.sizes = append(stats.sizes, int(imageFile.Size()))
+			if imageFile.Size() == 0 {
+				stats.empty = append(stats.empty, path)
+				continue
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				stats.corrupt[path] = err
+				continue
+			}
+			// decode the whole image since DecodeConfig
+			// doesn't notice truncated files
+			img, format, err := image.Decode(bytes.NewReader(b))
+			if err != nil {
+				stats.corrupt[path] = err
+				continue
+			}
+			stats.formats[format]++
+			stats.widths = append(stats.widths, img.Bounds().Dx())
+			stats.heights = append(stats.heights, img.Bounds().Dy())
+		}
+	}
+	return stats, nil
+}
+
+func (s *datasetStats) print() {
+	fmt.Println()
+	fmt.Println("Classes")
+	fmt.Println("-------")
+	var classNames []string
+	for class := range s.classes {
+		classNames = append(classNames, class)
+	}
+	sort.Strings(classNames)
+	for _, class := range classNames {
+		fmt.Printf("%s:\t%d image(s)\n", class, s.classes[class])
+	}
+	fmt.Println()
+	fmt.Println("Images")
+	fmt.Println("------")
+	fmt.Printf("File size (bytes):\t%s\n", evaluate.Summarise(s.sizes))
+	fmt.Printf("Width (px):\t\t%s\n", evaluate.Summarise(s.widths))
+	fmt.Printf("Height (px):\t\t%s\n", evaluate.Summarise(s.heights))
+	var formats []string
+	for format := range s.formats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		fmt.Printf("%s:\t\t\t%d image(s)\n", format, s.formats[format])
+	}
+	fmt.Println()
+	if len(s.hidden) > 0 {
+		fmt.Printf("Skipped %d hidden file(s):\n", len(s.hidden))
+		for _, path := range s.hidden {
+			fmt.Println("  " + path)
+		}
+		fmt.Println()
+	}
+	if len(s.empty) > 0 {
+		fmt.Printf("ERROR: %d empty file(s):\n", len(s.empty))
+		for _, path := range s.empty {
+			fmt.Println("  " + path)
+		}
+		fmt.Println()
+	}
+	if len(s.corrupt) > 0 {
+		fmt.Printf("ERROR: %d file(s) could not be decoded:\n", len(s.corrupt))
+		var paths []string
+		for path := range s.corrupt {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Printf("  %s: %s\n", path, s.corrupt[path])
+		}
+		fmt.Println()
+	}
+}
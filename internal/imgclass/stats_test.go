@@ -0,0 +1,42 @@
+package imgclass
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestStats(t *testing.T) {
+	is := is.New(t)
+
+	stats, err := collectStats(context.Background(), "testdata/catsdogs")
+	is.NoErr(err)
+	is.Equal(len(stats.classes), 2)
+	is.Equal(stats.classes["cats"], 3)
+	is.Equal(stats.classes["dogs"], 3)
+	is.Equal(len(stats.sizes), 6)
+	is.Equal(len(stats.widths), 6)
+	is.Equal(stats.formats["jpeg"], 6)
+	is.Equal(len(stats.empty), 0)
+	is.Equal(len(stats.corrupt), 0)
+}
+
+func TestStatsHidden(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "imgclass")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	is.NoErr(os.MkdirAll(filepath.Join(dir, "cats", ".thumbnails"), 0755))
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, ".DS_Store"), []byte("junk"), 0644))
+	is.NoErr(ioutil.WriteFile(filepath.Join(dir, "cats", "cat.jpg"), nil, 0644))
+
+	stats, err := collectStats(context.Background(), dir)
+	is.NoErr(err)
+	is.Equal(stats.hidden, []string{filepath.Join(dir, ".DS_Store"), filepath.Join(dir, "cats", ".thumbnails")})
+	is.Equal(stats.empty, []string{filepath.Join(dir, "cats", "cat.jpg")})
+}
@@ -0,0 +1,425 @@
+package nevernude
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/machinebox/sdk-go/videobox"
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/pkg/errors"
+)
+
+// summary describes the command in help output.
+const summary = "Automatically cut out (or cover up) NSFW nudity from videos using Machine Box + ffmpeg"
+
+// Command is the nevernude command.
+var Command = cli.Command{
+	Name:    "nevernude",
+	Summary: summary,
+	Run:     Run,
+}
+
+// Run runs nevernude on the video file in args.
+func Run(ctx context.Context, args []string) error {
+	fmt.Print(`
+nevernude by Machine Box
+Powered by Videobox + Nudebox
+
+https://machinebox.io/
+@machineboxio
+
+`)
+	flags := cli.FlagSet("nevernude", summary+".\nusage: nevernude [flags] video-file")
+	var (
+		threshold    = flags.Float64("threshold", 0.4, "nudebox threshold (lower is more strict)")
+		videoboxAddr = flags.String("videobox", "http://localhost:8080", "Videobox address")
+		outFile      = flags.String("out", "", "output file (default will save file next to original)")
+		skipFrames   = flags.Int("skipframes", -1, "number of frames to skip between extractions (see Videobox docs)")
+		skipSeconds  = flags.Int("skipseconds", -1, "number of seconds to skip between extractions (see Videobox docs)")
+		mode         = flags.String("mode", "cut", "what to do with nudity: cut it out, or blur, pixelate or black out the picture while keeping the whole video and audio")
+		reencode     = flags.Bool("reencode", false, "encode the video again when cutting, so cuts are exact instead of at keyframes (slower)")
+	)
+	if ok, err := config.Parse("nevernude", flags, args); !ok {
+		return err
+	}
+	if *threshold < 0 || *threshold > 1 {
+		return errors.New("threshold must be between 0 and 1")
+	}
+	if _, ok := modes[*mode]; !ok {
+		return errors.New("mode must be cut, blur, pixelate or black")
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		return errors.New("specify a video file")
+	}
+	inFile := args[0]
+	ext := filepath.Ext(inFile)
+	localtmp := fmt.Sprintf(".nevernude-%d", time.Now().Unix())
+	tmpdir := filepath.Join(localtmp, filepath.Base(inFile))
+	if err := os.MkdirAll(tmpdir, 0777); err != nil {
+		return errors.Wrap(err, "make temp directory")
+	}
+	defer func() {
+		os.RemoveAll(localtmp)
+	}()
+	f, err := os.Open(inFile)
+	if err != nil {
+		return errors.New("open video")
+	}
+	defer f.Close()
+	vb, err := cli.Videobox(ctx, *videoboxAddr)
+	if err != nil {
+		return err
+	}
+	fmt.Println("posting file to Videobox...")
+	opts := videobox.NewCheckOptions()
+	opts.NudeboxThreshold(*threshold)
+	if *skipFrames > -1 {
+		opts.SkipFrames(*skipFrames)
+	}
+	if *skipSeconds > -1 {
+		opts.SkipSeconds(*skipSeconds)
+	}
+	video, err := vb.Check(f, opts)
+	if err != nil {
+		return errors.Wrap(err, "videobox check")
+	}
+	fmt.Println("waiting for Videobox...")
+	results, video, err := waitForVideoboxResults(vb, video.ID)
+	if err != nil {
+		return errors.Wrap(err, "waiting for results")
+	}
+	fmt.Println("processing...")
+	bufferMS := 500 // buffer around the nudity
+	nude := nudeRanges(results, bufferMS, video.MillisecondsComplete)
+	fmt.Printf("found %d range(s) of nudity\n", len(nude))
+	output := *outFile
+	if output == "" {
+		output = inFile[:len(inFile)-len(ext)] + "-nevernude" + ext
+	}
+	if *mode == "cut" {
+		err = cut(ctx, inFile, output, tmpdir, keepRanges(nude, video.MillisecondsComplete), *reencode)
+	} else {
+		err = cover(ctx, inFile, output, *mode, nude)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("done.")
+	return nil
+}
+
+// cut cuts the ranges to keep out of the video, and stitches them
+// together into the output file.
+// Unless reencode is set, the video is copied as it is, so each range
+// can only start at a keyframe; the plan says how far each cut moves.
+func cut(ctx context.Context, inFile, output, tmpdir string, keepranges []rangeMS, reencode bool) error {
+	var keyframes []int
+	if !reencode {
+		var err error
+		if keyframes, err = probeKeyframes(ctx, inFile); err != nil {
+			return err
+		}
+	}
+	segments := planCuts(keepranges, keyframes, reencode)
+	printPlan(segments)
+	ext := filepath.Ext(inFile)
+	listFileName := filepath.Join(tmpdir, "segments.txt")
+	lf, err := os.Create(listFileName)
+	if err != nil {
+		return errors.Wrap(err, "create list file")
+	}
+	defer lf.Close()
+	fmt.Printf("breaking videos into %d segment(s)... (this can take a while)\n", len(segments))
+	for i, seg := range segments {
+		if seg.skipped() {
+			continue
+		}
+		segmentFile := fmt.Sprintf("%04d_%s-%s%s", i, seconds(seg.got.Start), seconds(seg.got.End), ext)
+		if _, err := io.WriteString(lf, "file '"+segmentFile+"'\n"); err != nil {
+			return errors.Wrap(err, "writing to list file")
+		}
+		ffmpegargs := []string{
+			"-y",
+			"-ss", seconds(seg.got.Start),
+			"-i", inFile,
+			"-t", seconds(seg.got.End - seg.got.Start),
+			"-map", "0:v:0", "-map", "0:a?",
+		}
+		if !reencode {
+			ffmpegargs = append(ffmpegargs, "-c", "copy", "-avoid_negative_ts", "make_zero")
+		}
+		ffmpegargs = append(ffmpegargs, filepath.Join(tmpdir, segmentFile))
+		out, err := exec.CommandContext(ctx, "ffmpeg", ffmpegargs...).CombinedOutput()
+		if err != nil {
+			return errors.Wrap(err, "ffpmeg: "+string(out))
+		}
+	}
+	if err := lf.Close(); err != nil {
+		return errors.Wrap(err, "writing to list file")
+	}
+	fmt.Println("stitching segments into", output+"...")
+	ffmpegargs := []string{
+		"-y", "-f", "concat", "-safe", "0", "-i", listFileName, "-c", "copy", output,
+	}
+	out, err := exec.CommandContext(ctx, "ffmpeg", ffmpegargs...).CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, "ffpmeg: "+string(out))
+	}
+	return nil
+}
+
+// segment is a part of the video to keep.
+type segment struct {
+	// want is the range that should be kept.
+	want rangeMS
+	// got is the range that will be kept, which starts later when it
+	// has to start at a keyframe. It's empty if there's no keyframe
+	// in the range.
+	got rangeMS
+}
+
+// skipped gets whether the segment is left out.
+func (s segment) skipped() bool {
+	return s.got.End <= s.got.Start
+}
+
+// planCuts plans how to cut the ranges to keep out of the video.
+// Unless the video is reencoded, each range has to start at a keyframe
+// (in ms, in order). It starts at the next one, rather than the one
+// before, so no nudity is kept.
+func planCuts(keepranges []rangeMS, keyframes []int, reencode bool) []segment {
+	segments := make([]segment, len(keepranges))
+	for i, r := range keepranges {
+		segments[i] = segment{want: r, got: r}
+		if reencode {
+			continue
+		}
+		k := sort.SearchInts(keyframes, r.Start)
+		if k == len(keyframes) || keyframes[k] >= r.End {
+			segments[i].got = rangeMS{Start: r.End, End: r.End}
+			continue
+		}
+		segments[i].got.Start = keyframes[k]
+	}
+	return segments
+}
+
+// printPlan describes how far each cut is from where it should be.
+func printPlan(segments []segment) {
+	for i, seg := range segments {
+		fmt.Printf("segment %d: keeping %ss to %ss", i, seconds(seg.want.Start), seconds(seg.want.End))
+		switch late := seg.got.Start - seg.want.Start; {
+		case seg.skipped():
+			fmt.Println(": skipped, no keyframe (use -reencode to keep it)")
+		case late > 0:
+			fmt.Printf(": starts %ss late, at a keyframe\n", seconds(late))
+		default:
+			fmt.Println(": exact")
+		}
+	}
+}
+
+// probeKeyframes gets the times of the keyframes in the video, in ms.
+// Times are rounded up, so seeking to them finds the same keyframe.
+func probeKeyframes(ctx context.Context, inFile string) ([]int, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-skip_frame", "nokey",
+		"-show_entries", "frame=pts_time",
+		"-of", "csv=p=0",
+		inFile,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "ffprobe: "+stderr.String())
+	}
+	return parseKeyframes(string(out)), nil
+}
+
+// parseKeyframes parses the keyframe times output by ffprobe.
+func parseKeyframes(out string) []int {
+	var keyframes []int
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.Trim(strings.TrimSpace(line), ",")
+		t, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			// N/A or blank
+			continue
+		}
+		keyframes = append(keyframes, int(math.Ceil(t*1000)))
+	}
+	sort.Ints(keyframes)
+	return keyframes
+}
+
+// modes are the filters that cover up nudity, keyed by the -mode they
+// are for. Each takes the main video stream as [0:v] and outputs [v],
+// and is only enabled when the expression is true.
+var modes = map[string]func(enable string) string{
+	// cut has no filter, since the nudity is cut out instead
+	"cut": nil,
+	"blur": func(enable string) string {
+		return "[0:v]boxblur=luma_radius='min(w,h)/20':luma_power=3:enable='" + enable + "'[v]"
+	},
+	"pixelate": func(enable string) string {
+		// scale down to a few blocks, then back up to the size of
+		// the original with big square pixels
+		return "[0:v]split[orig][small];" +
+			"[small]scale=32:-2:flags=area[blocks];" +
+			"[blocks][orig]scale2ref=w=main_w:h=main_h:flags=neighbor[pixelated][main];" +
+			"[main][pixelated]overlay=enable='" + enable + "'[v]"
+	},
+	"black": func(enable string) string {
+		return "[0:v]drawbox=x=0:y=0:w=iw:h=ih:color=black:t=fill:enable='" + enable + "'[v]"
+	},
+}
+
+// cover writes the whole video to the output file, with the picture
+// covered up by the mode's filter in the nude ranges. The audio is
+// copied as it is.
+func cover(ctx context.Context, inFile, output, mode string, nude []rangeMS) error {
+	ffmpegargs := []string{"-y", "-i", inFile}
+	if len(nude) == 0 {
+		ffmpegargs = append(ffmpegargs, "-map", "0:v:0", "-map", "0:a?", "-c", "copy", output)
+	} else {
+		ffmpegargs = append(ffmpegargs,
+			"-filter_complex", modes[mode](enableExpr(nude)),
+			"-map", "[v]", "-map", "0:a?", "-c:a", "copy",
+			output,
+		)
+	}
+	fmt.Printf("covering up %d range(s) with %s... (this can take a while)\n", len(nude), mode)
+	out, err := exec.CommandContext(ctx, "ffmpeg", ffmpegargs...).CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, "ffmpeg: "+string(out))
+	}
+	return nil
+}
+
+// enableExpr gets an ffmpeg expression that is true during the ranges.
+func enableExpr(ranges []rangeMS) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = "between(t," + seconds(r.Start) + "," + seconds(r.End) + ")"
+	}
+	return strings.Join(parts, "+")
+}
+
+// seconds formats milliseconds as seconds for ffmpeg.
+func seconds(ms int) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', 3, 64)
+}
+
+type rangeMS struct {
+	Start, End int
+}
+
+// nudeRanges gets the ranges of the video with nudity in, widened by
+// bufferMS either side, and merged where they overlap.
+func nudeRanges(results *videobox.VideoAnalysis, bufferMS, durationMS int) []rangeMS {
+	if results.Nudebox == nil {
+		return nil
+	}
+	var ranges []rangeMS
+	for _, nudity := range results.Nudebox.Nudity {
+		for _, instance := range nudity.Instances {
+			r := rangeMS{
+				Start: instance.StartMS - bufferMS,
+				End:   instance.EndMS + bufferMS,
+			}
+			if r.Start < 0 {
+				r.Start = 0
+			}
+			if durationMS > 0 && r.End > durationMS {
+				r.End = durationMS
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	var merged []rangeMS
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			if r.End > merged[n-1].End {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// keepRanges gets the ranges of the video between the nude ones.
+func keepRanges(nude []rangeMS, durationMS int) []rangeMS {
+	var keep []rangeMS
+	start := 0
+	for _, r := range nude {
+		if r.Start > start {
+			keep = append(keep, rangeMS{Start: start, End: r.Start})
+		}
+		start = r.End
+	}
+	if start < durationMS {
+		keep = append(keep, rangeMS{Start: start, End: durationMS})
+	}
+	return keep
+}
+
+func waitForVideoboxResults(vb *videobox.Client, id string) (*videobox.VideoAnalysis, *videobox.Video, error) {
+	var video *videobox.Video
+	err := func() error {
+		defer fmt.Println()
+		for {
+			time.Sleep(2 * time.Second)
+			var err error
+			video, err = vb.Status(id)
+			if err != nil {
+				return err
+			}
+			switch video.Status {
+			case videobox.StatusComplete:
+				return nil
+			case videobox.StatusFailed:
+				return errors.New("videobox: " + video.Error)
+			}
+			perc := float64(100) * (float64(video.FramesComplete) / float64(video.FramesCount))
+			if perc < 0 {
+				perc = 0
+			}
+			if perc > 100 {
+				perc = 100
+			}
+			fmt.Printf("\r%d%% complete...", int(perc))
+		}
+	}()
+	if err != nil {
+		return nil, video, err
+	}
+	results, err := vb.Results(id)
+	if err != nil {
+		return nil, video, errors.Wrap(err, "get results")
+	}
+	if err := vb.Delete(id); err != nil {
+		log.Println("videobox: failed to delete results (continuing regardless):", err)
+	}
+	return results, video, nil
+}
@@ -0,0 +1,66 @@
+package nevernude
+
+import (
+	"testing"
+
+	"github.com/machinebox/sdk-go/videobox"
+	"github.com/matryer/is"
+)
+
+func TestRanges(t *testing.T) {
+	is := is.New(t)
+
+	results := &videobox.VideoAnalysis{
+		Nudebox: &videobox.NudeboxVideoAnalysis{
+			Nudity: []videobox.Item{
+				{Instances: []videobox.Range{
+					{StartMS: 200, EndMS: 1000},
+					{StartMS: 5000, EndMS: 6000},
+				}},
+				{Instances: []videobox.Range{
+					{StartMS: 6200, EndMS: 7000},
+					{StartMS: 9800, EndMS: 9900},
+				}},
+			},
+		},
+	}
+	nude := nudeRanges(results, 500, 10000)
+	is.Equal(nude, []rangeMS{
+		{Start: 0, End: 1500},
+		{Start: 4500, End: 7500},
+		{Start: 9300, End: 10000},
+	})
+	is.Equal(keepRanges(nude, 10000), []rangeMS{
+		{Start: 1500, End: 4500},
+		{Start: 7500, End: 9300},
+	})
+	is.Equal(keepRanges(nil, 10000), []rangeMS{{Start: 0, End: 10000}})
+	is.Equal(len(nudeRanges(&videobox.VideoAnalysis{}, 500, 10000)), 0)
+
+	is.Equal(enableExpr(nude[:2]), "between(t,0.000,1.500)+between(t,4.500,7.500)")
+}
+
+func TestPlanCuts(t *testing.T) {
+	is := is.New(t)
+
+	keep := []rangeMS{
+		{Start: 0, End: 1500},
+		{Start: 4500, End: 7500},
+		{Start: 9300, End: 9800},
+	}
+	keyframes := parseKeyframes("0.000000\n2.002000,\n4.504500\nN/A\n6.006000\n8.008000\n")
+	is.Equal(keyframes, []int{0, 2002, 4505, 6006, 8008})
+
+	segments := planCuts(keep, keyframes, false)
+	is.Equal(segments[0].got, rangeMS{Start: 0, End: 1500})
+	is.True(!segments[0].skipped())
+	// starts at the next keyframe, so no nudity is kept
+	is.Equal(segments[1].got, rangeMS{Start: 4505, End: 7500})
+	// there's no keyframe before the end
+	is.True(segments[2].skipped())
+
+	segments = planCuts(keep, nil, true)
+	for i := range keep {
+		is.Equal(segments[i].got, keep[i])
+	}
+}
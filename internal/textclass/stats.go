@@ -0,0 +1,256 @@
+package textclass
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/machinebox/toys/config"
+	"github.com/machinebox/toys/internal/cli"
+	"github.com/machinebox/toys/internal/evaluate"
+	"github.com/pkg/errors"
+)
+
+// runStats reports on the dataset without talking to Classificationbox.
+// It returns an error if any files would fail to teach.
+func runStats(ctx context.Context, args []string) error {
+	flags := cli.FlagSet("textclass stats", "Report on the dataset without talking to Classificationbox.")
+	var (
+		src = flags.String("src", ".", "source of dataset")
+	)
+	if ok, err := config.Parse("textclass", flags, args); !ok {
+		return err
+	}
+	stats, err := collectStats(ctx, *src)
+	if err != nil {
+		return errors.Wrap(err, "stats")
+	}
+	stats.print()
+	if problems := len(stats.empty) + len(stats.undecodable) + len(stats.unreadable); problems > 0 {
+		return errors.Errorf("%d problem file(s) in dataset", problems)
+	}
+	if len(stats.classes) < 2 {
+		return errors.New("you need at least two classes")
+	}
+	return nil
+}
+
+// datasetStats describes the text files in a dataset.
+type datasetStats struct {
+	classes   map[string]int
+	lengths   []int
+	tokens    []int
+	languages map[string]int
+	// hidden are the files and folders skipped by skip.
+	hidden []string
+	// empty are files with no text in them.
+	empty []string
+	// undecodable are files that are not UTF-8 text.
+	undecodable []string
+	// unreadable are the files that could not be read.
+	unreadable map[string]error
+}
+
+func collectStats(ctx context.Context, src string) (*datasetStats, error) {
+	stats := &datasetStats{
+		classes:    make(map[string]int),
+		languages:  make(map[string]int),
+		unreadable: make(map[string]error),
+	}
+	classdirs, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range classdirs {
+		if skip(dir.Name()) {
+			stats.hidden = append(stats.hidden, filepath.Join(src, dir.Name()))
+			continue
+		}
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(src, dir.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, dir.Name())
+		}
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			path := filepath.Join(src, dir.Name(), file.Name())
+			if skip(file.Name()) {
+				stats.hidden = append(stats.hidden, path)
+				continue
+			}
+			if file.IsDir() {
+				continue
+			}
+			stats.classes[dir.Name()]++
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				stats.unreadable[path] = err
+				continue
+			}
+			if !utf8.Valid(b) || bytes.IndexByte(b, 0) != -1 {
+				stats.undecodable = append(stats.undecodable, path)
+				continue
+			}
+			text := string(b)
+			if strings.TrimSpace(text) == "" {
+				stats.empty = append(stats.empty, path)
+				continue
+			}
+			stats.lengths = append(stats.lengths, utf8.RuneCountInString(text))
+			stats.tokens = append(stats.tokens, len(strings.Fields(text)))
+			stats.languages[detectLanguage(text)]++
+		}
+	}
+	return stats, nil
+}
+
+func (s *datasetStats) print() {
+	fmt.Println()
+	fmt.Println("Classes")
+	fmt.Println("-------")
+	var classNames []string
+	for class := range s.classes {
+		classNames = append(classNames, class)
+	}
+	sort.Strings(classNames)
+	for _, class := range classNames {
+		fmt.Printf("%s:\t%d item(s)\n", class, s.classes[class])
+	}
+	fmt.Println()
+	fmt.Println("Items")
+	fmt.Println("-----")
+	fmt.Printf("Length (chars):\t%s\n", evaluate.Summarise(s.lengths))
+	fmt.Printf("Tokens:\t\t%s\n", evaluate.Summarise(s.tokens))
+	fmt.Println()
+	fmt.Println("Languages")
+	fmt.Println("---------")
+	var languages []string
+	for language := range s.languages {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		fmt.Printf("%s:\t%d item(s)\n", language, s.languages[language])
+	}
+	fmt.Println()
+	if len(s.hidden) > 0 {
+		fmt.Printf("Skipped %d hidden file(s):\n", len(s.hidden))
+		for _, path := range s.hidden {
+			fmt.Println("  " + path)
+		}
+		fmt.Println()
+	}
+	if len(s.empty) > 0 {
+		fmt.Printf("ERROR: %d empty file(s):\n", len(s.empty))
+		for _, path := range s.empty {
+			fmt.Println("  " + path)
+		}
+		fmt.Println()
+	}
+	if len(s.undecodable) > 0 {
+		fmt.Printf("ERROR: %d file(s) are not UTF-8 text:\n", len(s.undecodable))
+		for _, path := range s.undecodable {
+			fmt.Println("  " + path)
+		}
+		fmt.Println()
+	}
+	if len(s.unreadable) > 0 {
+		fmt.Printf("ERROR: %d file(s) could not be read:\n", len(s.unreadable))
+		var paths []string
+		for path := range s.unreadable {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Printf("  %s: %s\n", path, s.unreadable[path])
+		}
+		fmt.Println()
+	}
+}
+
+// scripts are the non-Latin writing systems detectLanguage knows about.
+var scripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"arabic", unicode.Arabic},
+	{"chinese", unicode.Han},
+	{"cyrillic", unicode.Cyrillic},
+	{"devanagari", unicode.Devanagari},
+	{"greek", unicode.Greek},
+	{"hebrew", unicode.Hebrew},
+	{"japanese", unicode.Hiragana},
+	{"japanese", unicode.Katakana},
+	{"korean", unicode.Hangul},
+	{"thai", unicode.Thai},
+}
+
+// stopwords are common words used to tell apart languages that
+// use the Latin alphabet.
+var stopwords = map[string][]string{
+	"dutch":      {"de", "het", "een", "en", "van", "niet", "dat", "is", "op", "met"},
+	"english":    {"the", "a", "and", "of", "to", "is", "in", "that", "this", "it", "with", "was"},
+	"french":     {"le", "la", "les", "et", "des", "est", "une", "que", "dans", "pas"},
+	"german":     {"der", "die", "und", "das", "ist", "nicht", "ein", "mit", "den", "sie"},
+	"italian":    {"il", "di", "che", "non", "per", "una", "sono", "della", "gli", "anche"},
+	"portuguese": {"o", "de", "que", "não", "uma", "os", "com", "para", "do", "em"},
+	"spanish":    {"el", "la", "de", "que", "y", "los", "las", "una", "por", "con"},
+}
+
+// detectLanguage makes a rough guess at the language of text, good
+// enough to spot items in an unexpected language.
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	var latin int
+	for _, r := range text {
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, script := range scripts {
+			if unicode.Is(script.table, r) {
+				counts[script.name]++
+				break
+			}
+		}
+	}
+	best, bestCount := "", latin
+	for name, count := range counts {
+		if count > bestCount || (count == bestCount && name < best) {
+			best, bestCount = name, count
+		}
+	}
+	if bestCount == 0 {
+		return "unknown"
+	}
+	if best != "" {
+		return best
+	}
+	words := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		words[word]++
+	}
+	best, bestCount = "unknown", 0
+	for language, list := range stopwords {
+		var count int
+		for _, word := range list {
+			count += words[word]
+		}
+		if count > bestCount || (count == bestCount && count > 0 && language < best) {
+			best, bestCount = language, count
+		}
+	}
+	return best
+}
@@ -0,0 +1,84 @@
+package textclass
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestStats(t *testing.T) {
+	is := is.New(t)
+
+	stats, err := collectStats(context.Background(), "testdata/fakenews")
+	is.NoErr(err)
+	is.Equal(len(stats.classes), 3)
+	is.Equal(stats.classes["fake"], 3)
+	is.Equal(len(stats.lengths), 9)
+	is.Equal(len(stats.empty), 0)
+	is.Equal(len(stats.undecodable), 0)
+	is.Equal(len(stats.unreadable), 0)
+}
+
+func TestStatsProblems(t *testing.T) {
+	is := is.New(t)
+
+	dir, err := ioutil.TempDir("", "textclass")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	write := func(path, text string) {
+		path = filepath.Join(dir, path)
+		is.NoErr(os.MkdirAll(filepath.Dir(path), 0755))
+		is.NoErr(ioutil.WriteFile(path, []byte(text), 0644))
+	}
+	write("spam/1.txt", "Buy now, this is the deal of the century")
+	write("spam/2.txt", "   ")
+	write("spam/3.txt", "\xff\xfe")
+	write("spam/.hidden.txt", "hidden")
+	write("ham/1.txt", "The meeting is at ten")
+	write(".DS_Store", "junk")
+	write(".git/HEAD", "ref: refs/heads/master")
+	is.NoErr(os.Symlink(filepath.Join(dir, "missing.txt"), filepath.Join(dir, "ham", "2.txt")))
+
+	stats, err := collectStats(context.Background(), dir)
+	is.NoErr(err) // problems are reported, not returned
+	is.Equal(stats.classes["spam"], 3)
+	is.Equal(stats.classes["ham"], 2)
+	is.Equal(stats.empty, []string{filepath.Join(dir, "spam", "2.txt")})
+	is.Equal(stats.undecodable, []string{filepath.Join(dir, "spam", "3.txt")})
+	is.Equal(len(stats.unreadable), 1)
+	is.True(stats.unreadable[filepath.Join(dir, "ham", "2.txt")] != nil)
+	is.Equal(len(stats.hidden), 3) // .DS_Store and .git at the top, and .hidden.txt
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		language string
+	}{
+		{"The cat sat on the mat and it was happy with the world.", "english"},
+		{"Le chat est sur la table et les enfants sont dans le jardin.", "french"},
+		{"Der Hund ist nicht mit den Kindern und die Katze ist das Tier.", "german"},
+		{"El perro y los gatos de la casa, con las flores por la mañana.", "spanish"},
+		{"Il gatto che non è per una casa, sono della famiglia anche gli altri.", "italian"},
+		{"Het is een kat en de hond van de buren is niet op straat met dat.", "dutch"},
+		{"Привет, как дела? Это текст на русском языке.", "cyrillic"},
+		{"Γεια σου κόσμε, αυτό είναι ελληνικό κείμενο.", "greek"},
+		{"これはひらがなとカタカナのテキストです", "japanese"},
+		{"这是一个中文句子", "chinese"},
+		{"안녕하세요 세계", "korean"},
+		{"مرحبا بالعالم", "arabic"},
+		{"שלום עולם", "hebrew"},
+		{"12345 !!! ???", "unknown"},
+		{"xyzzy plugh", "unknown"},
+		{"", "unknown"},
+	} {
+		t.Run(test.language, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(detectLanguage(test.text), test.language)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Package signedurl signs anonproxy URLs, so that only links made by
+// someone who knows the secret are served.
+//
+// The signature is an HMAC-SHA256 of the method, the path and the query
+// string (the src image, the options and the expiry time), so none of
+// them can be changed without making a new signature, and a link can't
+// be used for another endpoint:
+//
+//	link, err := signedurl.Sign("GET", "http://localhost:8000/?src=https://example.com/people.jpg&style=blur",
+//		secret, time.Now().Add(24*time.Hour))
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query parameters added to signed URLs.
+const (
+	// SignatureParam is the signature.
+	SignatureParam = "sig"
+	// ExpiresParam is when the URL expires, in seconds since the Unix
+	// epoch.
+	ExpiresParam = "expires"
+)
+
+var (
+	// ErrUnsigned is returned when a URL has no signature.
+	ErrUnsigned = errors.New("url is not signed")
+	// ErrBadSignature is returned when the signature doesn't match the
+	// URL.
+	ErrBadSignature = errors.New("url signature does not match")
+	// ErrExpired is returned when a URL has expired.
+	ErrExpired = errors.New("url has expired")
+)
+
+// Sign adds an expiry time and a signature to rawurl, for requests with
+// the method.
+// A zero expires makes a URL that never expires.
+func Sign(method, rawurl string, secret []byte, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Del(SignatureParam)
+	query.Del(ExpiresParam)
+	if !expires.IsZero() {
+		query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	}
+	query.Set(SignatureParam, signature(method, u.Path, query, secret))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Verify checks that a request with the method, path and query was
+// signed with the secret, and hasn't expired at now.
+func Verify(method, path string, query url.Values, secret []byte, now time.Time) error {
+	sig := query.Get(SignatureParam)
+	if sig == "" {
+		return ErrUnsigned
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(method, path, query, secret))) {
+		return ErrBadSignature
+	}
+	if expires := query.Get(ExpiresParam); expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, ExpiresParam)
+		}
+		if !now.Before(time.Unix(seconds, 0)) {
+			return ErrExpired
+		}
+	}
+	return nil
+}
+
+// signature gets the signature of a request, leaving out any signature
+// already in the query.
+// The query is encoded with its keys sorted, so the order of the
+// parameters in the URL doesn't matter.
+func signature(method, path string, query url.Values, secret []byte) string {
+	if path == "" {
+		path = "/"
+	}
+	unsigned := make(url.Values, len(query))
+	for key, values := range query {
+		if key != SignatureParam {
+			unsigned[key] = values
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToUpper(method) + "\n" + path + "\n" + unsigned.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
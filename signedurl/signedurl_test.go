@@ -0,0 +1,60 @@
+package signedurl
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestSign(t *testing.T) {
+	is := is.New(t)
+
+	secret := []byte("secret")
+	now := time.Unix(1500000000, 0)
+	link, err := Sign("GET", "http://localhost:8000/?src=https://example.com/people.jpg&style=blur", secret, now.Add(time.Hour))
+	is.NoErr(err)
+	u, err := url.Parse(link)
+	is.NoErr(err)
+	query := u.Query()
+	is.Equal(query.Get("src"), "https://example.com/people.jpg")
+	is.Equal(query.Get("style"), "blur")
+	is.Equal(query.Get(ExpiresParam), "1500003600")
+	is.NoErr(Verify("GET", "/", query, secret, now))
+
+	is.Equal(Verify("GET", "/", query, secret, now.Add(time.Hour)), ErrExpired)
+	is.Equal(Verify("GET", "/", query, []byte("wrong"), now), ErrBadSignature)
+	is.Equal(Verify("GET", "/faces", query, secret, now), ErrBadSignature) // path is signed
+	is.Equal(Verify("POST", "/", query, secret, now), ErrBadSignature)     // method is signed
+	is.NoErr(Verify("get", "", query, secret, now))
+
+	tampered := url.Values{}
+	for key, values := range query {
+		tampered[key] = values
+	}
+	tampered.Set("style", "solid")
+	is.Equal(Verify("GET", "/", tampered, secret, now), ErrBadSignature) // options are signed
+	tampered = url.Values{}
+	for key, values := range query {
+		tampered[key] = values
+	}
+	tampered.Set(ExpiresParam, "1600000000")
+	is.Equal(Verify("GET", "/", tampered, secret, now), ErrBadSignature) // expiry is signed
+
+	query.Del(SignatureParam)
+	is.Equal(Verify("GET", "/", query, secret, now), ErrUnsigned)
+}
+
+func TestSignNoExpiry(t *testing.T) {
+	is := is.New(t)
+
+	secret := []byte("secret")
+	link, err := Sign("GET", "http://localhost:8000/faces?src=https://example.com/people.jpg&expires=1&sig=old", secret, time.Time{})
+	is.NoErr(err)
+	u, err := url.Parse(link)
+	is.NoErr(err)
+	query := u.Query()
+	is.Equal(query.Get(ExpiresParam), "") // old expiry removed
+	is.NoErr(Verify("GET", "/faces", query, secret, time.Now().Add(100*365*24*time.Hour)))
+}